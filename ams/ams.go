@@ -0,0 +1,60 @@
+// Package ams decodes the data pushed by AMS power meters on their HAN port.
+//
+// The meter sends DLMS/COSEM data-notifications inside HDLC frames. Frames are
+// cut out of the byte stream with a Deframer and decoded into a Reading with
+// Decode. Kamstrup, Aidon and Kaifa meters are supported, the vendor is
+// detected from the list version identifier. Frames encrypted with DLMS
+// general-glo-ciphering are decoded by a Decoder given the meter keys. The
+// package has no global state and does not log.
+package ams
+
+// DateTime is a COSEM date-time as sent by the meter.
+type DateTime struct {
+	Year        uint16
+	Month       uint8
+	Day         uint8
+	Weekday     uint8
+	Hour        uint8
+	Minute      uint8
+	Second      uint8
+	Hundreds    uint8
+	Deviation   uint16
+	ClockStatus uint8
+}
+
+// Reading is the decoded content of a single frame. Measured values are in
+// the base unit of the register, such as W, A, V and Wh. Registers the frame
+// did not carry are left zero, Quantity tells them apart from a measured 0.
+// Lists sent every few seconds may also leave out the meter ID and type.
+type Reading struct {
+	Clock       DateTime
+	Vendor      string
+	ListVersion string
+
+	MeterID            string
+	MeterType          string
+	ActivePowerPlus    Quantity
+	ActivePowerMinus   Quantity
+	ReactivePowerPlus  Quantity
+	ReactivePowerMinus Quantity
+	L1Current          Quantity
+	L2Current          Quantity
+	L3Current          Quantity
+	L1Voltage          Quantity
+	L2Voltage          Quantity
+	L3Voltage          Quantity
+
+	// Hourly list only
+	MeterClock          DateTime
+	ActiveEnergyPlus    Quantity
+	ActiveEnergyMinus   Quantity
+	ReactiveEnergyPlus  Quantity
+	ReactiveEnergyMinus Quantity
+	HasEnergy           bool
+
+	// Registers not in the register table, in the order they were sent
+	Unknown []RawRegister
+
+	// OBIS codes of the register table carried by the frame
+	present map[string]bool
+}
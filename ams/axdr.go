@@ -0,0 +1,444 @@
+package ams
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/ghostiam/binstruct"
+)
+
+// DataType is the tag of an A-XDR encoded COSEM data value.
+type DataType uint8
+
+// COSEM data types, IEC 62056-6-2.
+const (
+	TypeNull          DataType = 0
+	TypeArray         DataType = 1
+	TypeStructure     DataType = 2
+	TypeBoolean       DataType = 3
+	TypeBitString     DataType = 4
+	TypeInt32         DataType = 5 // double-long
+	TypeUint32        DataType = 6 // double-long-unsigned
+	TypeOctetString   DataType = 9
+	TypeVisibleString DataType = 10
+	TypeUTF8String    DataType = 12
+	TypeBCD           DataType = 13
+	TypeInt8          DataType = 15 // integer
+	TypeInt16         DataType = 16 // long
+	TypeUint8         DataType = 17 // unsigned
+	TypeUint16        DataType = 18 // long-unsigned
+	TypeCompactArray  DataType = 19
+	TypeInt64         DataType = 20 // long64
+	TypeUint64        DataType = 21 // long64-unsigned
+	TypeEnum          DataType = 22
+	TypeFloat32       DataType = 23
+	TypeFloat64       DataType = 24
+	TypeDateTime      DataType = 25
+	TypeDate          DataType = 26
+	TypeTime          DataType = 27
+	TypeDeltaInt8     DataType = 28 // delta-integer
+	TypeDeltaInt16    DataType = 29 // delta-long
+	TypeDeltaInt32    DataType = 30 // delta-double-long
+	TypeDeltaUint8    DataType = 31 // delta-unsigned
+	TypeDeltaUint16   DataType = 32 // delta-long-unsigned
+	TypeDeltaUint32   DataType = 33 // delta-double-long-unsigned
+	TypeDontCare      DataType = 255
+)
+
+// maxValueDepth limits the nesting of arrays and structures.
+const maxValueDepth = 16
+
+// Value is a decoded A-XDR data value. Which of the fields is set depends on
+// the type:
+//
+//   - Elements: array, structure
+//   - Int: boolean (0 or 1), int8, int16, int32, int64 and their deltas
+//   - Uint: uint8, uint16, uint32, uint64, enum and their deltas
+//   - Float: float32, float64
+//   - Bytes: bit-string, octet-string, visible-string, utf8-string, bcd,
+//     date-time, date, time, and the undecoded contents of a compact-array
+//
+// Bits holds the length of a bit-string in bits.
+type Value struct {
+	Type     DataType
+	Elements []Value
+	Int      int64
+	Uint     uint64
+	Float    float64
+	Bytes    []byte
+	Bits     int
+}
+
+// DecodeValue decodes one A-XDR encoded value, including its type tag, from
+// data. It returns the value and the number of bytes consumed.
+func DecodeValue(data []byte) (Value, int, error) {
+	reader := binstruct.NewReaderFromBytes(data, binary.BigEndian, false)
+
+	v, err := decodeValue(reader, 0)
+	if err != nil {
+		return Value{}, 0, err
+	}
+
+	n, err := reader.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return Value{}, 0, err
+	}
+
+	return v, int(n), nil
+}
+
+func decodeValue(reader binstruct.Reader, depth int) (Value, error) {
+	tag, err := reader.ReadUint8()
+	if err != nil {
+		return Value{}, err
+	}
+
+	v := Value{Type: DataType(tag)}
+
+	switch v.Type {
+	case TypeNull, TypeDontCare:
+	case TypeArray, TypeStructure:
+		if depth >= maxValueDepth {
+			return Value{}, fmt.Errorf("value nested too deep")
+		}
+		count, err := readLength(reader)
+		if err != nil {
+			return Value{}, err
+		}
+		v.Elements = make([]Value, 0, count)
+		for i := 0; i < count; i++ {
+			e, err := decodeValue(reader, depth+1)
+			if err != nil {
+				return Value{}, err
+			}
+			v.Elements = append(v.Elements, e)
+		}
+	case TypeBoolean:
+		b, err := reader.ReadUint8()
+		if err != nil {
+			return Value{}, err
+		}
+		if b != 0 {
+			v.Int = 1
+		}
+	case TypeBitString:
+		bits, err := readRawLength(reader)
+		if err != nil {
+			return Value{}, err
+		}
+		size := (bits + 7) / 8
+		if err := checkLength(reader, size); err != nil {
+			return Value{}, err
+		}
+		v.Bits = int(bits)
+		v.Bytes, err = readBytes(reader, int(size))
+		if err != nil {
+			return Value{}, err
+		}
+	case TypeOctetString, TypeVisibleString, TypeUTF8String:
+		length, err := readLength(reader)
+		if err != nil {
+			return Value{}, err
+		}
+		v.Bytes, err = readBytes(reader, length)
+		if err != nil {
+			return Value{}, err
+		}
+	case TypeBCD, TypeInt8, TypeDeltaInt8:
+		n, err := reader.ReadInt8()
+		if err != nil {
+			return Value{}, err
+		}
+		if v.Type == TypeBCD {
+			v.Bytes = []byte{byte(n)}
+		} else {
+			v.Int = int64(n)
+		}
+	case TypeInt16, TypeDeltaInt16:
+		n, err := reader.ReadInt16()
+		v.Int = int64(n)
+		if err != nil {
+			return Value{}, err
+		}
+	case TypeInt32, TypeDeltaInt32:
+		n, err := reader.ReadInt32()
+		v.Int = int64(n)
+		if err != nil {
+			return Value{}, err
+		}
+	case TypeInt64:
+		v.Int, err = reader.ReadInt64()
+		if err != nil {
+			return Value{}, err
+		}
+	case TypeUint8, TypeEnum, TypeDeltaUint8:
+		n, err := reader.ReadUint8()
+		v.Uint = uint64(n)
+		if err != nil {
+			return Value{}, err
+		}
+	case TypeUint16, TypeDeltaUint16:
+		n, err := reader.ReadUint16()
+		v.Uint = uint64(n)
+		if err != nil {
+			return Value{}, err
+		}
+	case TypeUint32, TypeDeltaUint32:
+		n, err := reader.ReadUint32()
+		v.Uint = uint64(n)
+		if err != nil {
+			return Value{}, err
+		}
+	case TypeUint64:
+		v.Uint, err = reader.ReadUint64()
+		if err != nil {
+			return Value{}, err
+		}
+	case TypeFloat32:
+		n, err := reader.ReadUint32()
+		v.Float = float64(math.Float32frombits(n))
+		if err != nil {
+			return Value{}, err
+		}
+	case TypeFloat64:
+		n, err := reader.ReadUint64()
+		v.Float = math.Float64frombits(n)
+		if err != nil {
+			return Value{}, err
+		}
+	case TypeCompactArray:
+		// The contents are kept undecoded after the type description
+		if err := skipTypeDescription(reader, 0); err != nil {
+			return Value{}, err
+		}
+		length, err := readLength(reader)
+		if err != nil {
+			return Value{}, err
+		}
+		v.Bytes, err = readBytes(reader, length)
+		if err != nil {
+			return Value{}, err
+		}
+	case TypeDateTime:
+		v.Bytes, err = readBytes(reader, 12)
+		if err != nil {
+			return Value{}, err
+		}
+	case TypeDate:
+		v.Bytes, err = readBytes(reader, 5)
+		if err != nil {
+			return Value{}, err
+		}
+	case TypeTime:
+		v.Bytes, err = readBytes(reader, 4)
+		if err != nil {
+			return Value{}, err
+		}
+	default:
+		return Value{}, fmt.Errorf("unsupported data type %d", tag)
+	}
+
+	return v, nil
+}
+
+// skipTypeDescription reads the type description of a compact-array: a type
+// tag, followed for an array by the element count and element type and for a
+// structure by the number of elements and their types.
+func skipTypeDescription(reader binstruct.Reader, depth int) error {
+	if depth >= maxValueDepth {
+		return fmt.Errorf("type description nested too deep")
+	}
+
+	tag, err := reader.ReadUint8()
+	if err != nil {
+		return err
+	}
+
+	switch DataType(tag) {
+	case TypeArray:
+		if _, err := reader.ReadUint16(); err != nil {
+			return err
+		}
+		return skipTypeDescription(reader, depth+1)
+	case TypeStructure:
+		count, err := readLength(reader)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < count; i++ {
+			if err := skipTypeDescription(reader, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// readLength reads an A-XDR length. Lengths below 128 are a single byte,
+// otherwise the low 7 bits of the first byte give the number of length bytes
+// that follow. Every element or byte counted by a length takes at least one
+// byte, so lengths beyond the remaining data are rejected.
+//
+// Bit-string lengths count bits and are read with readRawLength instead.
+func readLength(reader binstruct.Reader) (int, error) {
+	n, err := readRawLength(reader)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkLength(reader, n); err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+// checkLength rejects a length beyond the remaining data. Lengths are
+// compared before converting them to int, which is 32 bits on some targets.
+func checkLength(reader binstruct.Reader, n uint64) error {
+	remaining, err := remainingBytes(reader)
+	if err != nil {
+		return err
+	}
+	if n > uint64(remaining) {
+		return fmt.Errorf("length %d exceeds remaining %d bytes", n, remaining)
+	}
+
+	return nil
+}
+
+// readRawLength reads an A-XDR length of up to 4 length bytes without
+// checking it against the data
+func readRawLength(reader binstruct.Reader) (uint64, error) {
+	b, err := reader.ReadUint8()
+	if err != nil {
+		return 0, err
+	}
+	if b < 0x80 {
+		return uint64(b), nil
+	}
+
+	numBytes := int(b & 0x7f)
+	if numBytes == 0 || numBytes > 4 {
+		return 0, fmt.Errorf("invalid length encoding %02x", b)
+	}
+	return reader.ReadUintX(numBytes)
+}
+
+func remainingBytes(reader binstruct.Reader) (int64, error) {
+	pos, err := reader.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	end, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := reader.Seek(pos, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	return end - pos, nil
+}
+
+// readBytes reads exactly n bytes.
+func readBytes(reader binstruct.Reader, n int) ([]byte, error) {
+	remaining, err := remainingBytes(reader)
+	if err != nil {
+		return nil, err
+	}
+	if int64(n) > remaining {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	read, b, err := reader.ReadBytes(n)
+	if err != nil {
+		return nil, err
+	}
+	if read != n {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return b, nil
+}
+
+// Integer returns the value of any integer, enum or boolean type.
+func (v Value) Integer() (int64, bool) {
+	switch v.Type {
+	case TypeBoolean, TypeInt8, TypeInt16, TypeInt32, TypeInt64,
+		TypeDeltaInt8, TypeDeltaInt16, TypeDeltaInt32:
+		return v.Int, true
+	case TypeUint8, TypeUint16, TypeUint32, TypeUint64, TypeEnum,
+		TypeDeltaUint8, TypeDeltaUint16, TypeDeltaUint32:
+		return int64(v.Uint), true
+	}
+
+	return 0, false
+}
+
+// Number returns the value of any integer, enum or floating point type.
+func (v Value) Number() (float64, bool) {
+	switch v.Type {
+	case TypeFloat32, TypeFloat64:
+		return v.Float, true
+	case TypeUint64:
+		return float64(v.Uint), true
+	}
+
+	n, ok := v.Integer()
+	return float64(n), ok
+}
+
+// Text returns the content of an octet-string, visible-string or utf8-string.
+func (v Value) Text() (string, bool) {
+	switch v.Type {
+	case TypeOctetString, TypeVisibleString, TypeUTF8String:
+		return string(v.Bytes), true
+	}
+
+	return "", false
+}
+
+// DateTime returns the content of a date-time, or of a 12 byte octet-string
+// which is how date-time is commonly sent.
+func (v Value) DateTime() (DateTime, bool) {
+	var dt DateTime
+
+	if (v.Type != TypeDateTime && v.Type != TypeOctetString) || len(v.Bytes) != 12 {
+		return dt, false
+	}
+	if err := binstruct.UnmarshalBE(v.Bytes, &dt); err != nil {
+		return dt, false
+	}
+
+	return dt, true
+}
+
+func (v Value) String() string {
+	switch v.Type {
+	case TypeNull, TypeDontCare:
+		return "null"
+	case TypeArray, TypeStructure:
+		elements := make([]string, len(v.Elements))
+		for i, e := range v.Elements {
+			elements[i] = e.String()
+		}
+		return "{" + strings.Join(elements, ", ") + "}"
+	case TypeVisibleString, TypeUTF8String:
+		return fmt.Sprintf("%q", v.Bytes)
+	case TypeFloat32, TypeFloat64:
+		return fmt.Sprintf("%g", v.Float)
+	}
+
+	if n, ok := v.Integer(); ok {
+		if v.Type == TypeUint64 {
+			return fmt.Sprintf("%d", v.Uint)
+		}
+		return fmt.Sprintf("%d", n)
+	}
+
+	return fmt.Sprintf("%x", v.Bytes)
+}
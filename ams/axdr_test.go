@@ -0,0 +1,171 @@
+package ams
+
+import (
+	"encoding/hex"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeValue(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want Value
+		n    int
+	}{
+		{"null", "00", Value{Type: TypeNull}, 1},
+		{"boolean", "0302", Value{Type: TypeBoolean, Int: 1}, 2},
+		{"int8", "0ffe", Value{Type: TypeInt8, Int: -2}, 2},
+		{"int16", "10ff38", Value{Type: TypeInt16, Int: -200}, 3},
+		{"int32", "05fffffc18", Value{Type: TypeInt32, Int: -1000}, 5},
+		{"int64", "14fffffffffffffffe", Value{Type: TypeInt64, Int: -2}, 9},
+		{"uint8", "11ff", Value{Type: TypeUint8, Uint: 255}, 2},
+		{"uint16", "1208fc", Value{Type: TypeUint16, Uint: 2300}, 3},
+		{"uint32", "06000004d2", Value{Type: TypeUint32, Uint: 1234}, 5},
+		{"uint64", "15ffffffffffffffff", Value{Type: TypeUint64, Uint: math.MaxUint64}, 9},
+		{"enum", "161b", Value{Type: TypeEnum, Uint: 27}, 2},
+		{"float32", "173fc00000", Value{Type: TypeFloat32, Float: 1.5}, 5},
+		{"float64", "18c004000000000000", Value{Type: TypeFloat64, Float: -2.5}, 9},
+		{"delta int32", "1efffffffb", Value{Type: TypeDeltaInt32, Int: -5}, 5},
+		{"delta uint16", "200102", Value{Type: TypeDeltaUint16, Uint: 258}, 3},
+		{"bcd", "0d12", Value{Type: TypeBCD, Bytes: []byte{0x12}}, 2},
+		{"bit-string", "040ab3c0", Value{Type: TypeBitString, Bits: 10, Bytes: []byte{0xb3, 0xc0}}, 4},
+		{"octet-string", "0906010001070aff", Value{Type: TypeOctetString, Bytes: []byte{1, 0, 1, 7, 10, 255}}, 8},
+		{"visible-string", "0a034b464d", Value{Type: TypeVisibleString, Bytes: []byte("KFM")}, 5},
+		{"utf8-string", "0c02c3a6", Value{Type: TypeUTF8String, Bytes: []byte("æ")}, 4},
+		{"date", "1a07e60a1101", Value{Type: TypeDate, Bytes: []byte{0x07, 0xe6, 0x0a, 0x11, 0x01}}, 6},
+		{"time", "1b0a000000", Value{Type: TypeTime, Bytes: []byte{0x0a, 0, 0, 0}}, 5},
+		{"don't care", "ff", Value{Type: TypeDontCare}, 1},
+		{"trailing data", "1100aabb", Value{Type: TypeUint8}, 2},
+		{
+			"structure", "020211010a0141",
+			Value{Type: TypeStructure, Elements: []Value{
+				{Type: TypeUint8, Uint: 1},
+				{Type: TypeVisibleString, Bytes: []byte("A")},
+			}}, 7,
+		},
+		{
+			"nested array", "0101020112002a",
+			Value{Type: TypeArray, Elements: []Value{
+				{Type: TypeStructure, Elements: []Value{{Type: TypeUint16, Uint: 42}}},
+			}}, 7,
+		},
+		{"empty array", "0100", Value{Type: TypeArray, Elements: []Value{}}, 2},
+		{
+			"compact-array", "130202111204" + "0100020003",
+			Value{Type: TypeCompactArray, Bytes: []byte{0x01, 0x00, 0x02, 0x00}}, 10,
+		},
+		{
+			"compact-array of arrays", "1301000211" + "03010203",
+			Value{Type: TypeCompactArray, Bytes: []byte{1, 2, 3}}, 9,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := hex.DecodeString(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, n, err := DecodeValue(data)
+			if err != nil {
+				t.Fatalf("DecodeValue() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DecodeValue() = %#v, want %#v", got, tt.want)
+			}
+			if n != tt.n {
+				t.Errorf("DecodeValue() consumed %d bytes, want %d", n, tt.n)
+			}
+		})
+	}
+}
+
+func TestDecodeValueLongLength(t *testing.T) {
+	// Lengths of 128 and more have a length of length byte
+	data := append([]byte{0x09, 0x81, 0xc8}, make([]byte, 200)...)
+	v, n, err := DecodeValue(data)
+	if err != nil || len(v.Bytes) != 200 || n != len(data) {
+		t.Fatalf("DecodeValue() = %d bytes, consumed %d, error %v", len(v.Bytes), n, err)
+	}
+
+	data = append([]byte{0x0a, 0x82, 0x01, 0x2c}, make([]byte, 300)...)
+	v, n, err = DecodeValue(data)
+	if err != nil || len(v.Bytes) != 300 || n != len(data) {
+		t.Fatalf("DecodeValue() = %d bytes, consumed %d, error %v", len(v.Bytes), n, err)
+	}
+}
+
+func TestDecodeValueErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"truncated uint32", "06000004"},
+		{"truncated int64", "1400000000"},
+		{"truncated string", "0a05414243"},
+		{"truncated structure", "0203110111"},
+		{"truncated length", "0982"},
+		{"length beyond data", "0a7f41"},
+		{"array count beyond data", "01ff"},
+		{"invalid length encoding", "098041"},
+		{"length of length too long", "0985000000000141"},
+		{"unsupported type", "07"},
+		{"truncated date-time", "1907e60a11"},
+		{"truncated compact-array", "1311"},
+		{"nested too deep", strings.Repeat("0101", 20) + "00"},
+
+		// Lengths that do not fit a 32 bit int
+		{"array count above 2^31", "01848000000000"},
+		{"structure count of 2^32-1", "0284ffffffff00"},
+		{"string length above 2^31", "0984800000004141"},
+		{"bit-string length above 2^31", "04848000000041"},
+		{"bit-string length of 2^32-1", "0484ffffffff41"},
+		{"compact-array length above 2^31", "1311848000000041"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := hex.DecodeString(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if v, _, err := DecodeValue(data); err == nil {
+				t.Errorf("DecodeValue() = %v, want error", v)
+			}
+		})
+	}
+}
+
+func TestValueAccessors(t *testing.T) {
+	if n, ok := (Value{Type: TypeInt16, Int: -3}).Number(); !ok || n != -3 {
+		t.Errorf("int16 Number() = %v, %v", n, ok)
+	}
+	if n, ok := (Value{Type: TypeUint64, Uint: math.MaxUint64}).Number(); !ok || n != math.MaxUint64 {
+		t.Errorf("uint64 Number() = %v, %v", n, ok)
+	}
+	if _, ok := (Value{Type: TypeOctetString}).Number(); ok {
+		t.Error("octet-string Number() ok")
+	}
+	if s, ok := (Value{Type: TypeVisibleString, Bytes: []byte("AIDON_V0001")}).Text(); !ok || s != "AIDON_V0001" {
+		t.Errorf("visible-string Text() = %q, %v", s, ok)
+	}
+	if _, ok := (Value{Type: TypeUint32}).Text(); ok {
+		t.Error("uint32 Text() ok")
+	}
+
+	clock, _ := hex.DecodeString("07e60a11010a000000ffc400")
+	dt, ok := (Value{Type: TypeOctetString, Bytes: clock}).DateTime()
+	want := DateTime{Year: 2022, Month: 10, Day: 17, Weekday: 1, Hour: 10, Deviation: 0xffc4}
+	if !ok || dt != want {
+		t.Errorf("DateTime() = %+v, %v, want %+v", dt, ok, want)
+	}
+	if _, ok := (Value{Type: TypeOctetString, Bytes: clock[:11]}).DateTime(); ok {
+		t.Error("DateTime() of 11 bytes ok")
+	}
+}
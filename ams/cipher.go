@@ -0,0 +1,130 @@
+package ams
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ghostiam/binstruct"
+)
+
+// General-glo-ciphering APDU tag
+const tagGeneralGloCiphering = 0xdb
+
+// Security control byte bits
+const (
+	securityAuthentication = 0x10
+	securityEncryption     = 0x20
+	securityCompression    = 0x80
+)
+
+// authTagSize is the length of the GCM authentication tag used by DLMS
+const authTagSize = 12
+
+// decrypt reads a general-glo-ciphering APDU, without its tag, and returns
+// the protected APDU. The nonce is the system title of the meter followed by
+// the frame counter. The authentication tag is only verified when an
+// authentication key is given.
+func (d *Decoder) decrypt(reader binstruct.Reader) ([]byte, error) {
+	titleLen, err := readLength(reader)
+	if err != nil {
+		return nil, err
+	}
+	systemTitle, err := readBytes(reader, titleLen)
+	if err != nil {
+		return nil, err
+	}
+	if len(systemTitle) != 8 {
+		return nil, fmt.Errorf("%w: system title length %d", ErrUnsupported, len(systemTitle))
+	}
+
+	n, err := readLength(reader)
+	if err != nil {
+		return nil, err
+	}
+	if n < 5 {
+		return nil, fmt.Errorf("ciphered content too short")
+	}
+	content, err := readBytes(reader, n)
+	if err != nil {
+		return nil, err
+	}
+
+	security := content[0]
+	frameCounter := binary.BigEndian.Uint32(content[1:5])
+	data := content[5:]
+
+	if security&securityCompression != 0 {
+		return nil, fmt.Errorf("%w: compressed APDU", ErrUnsupported)
+	}
+
+	var tag []byte
+	if security&securityAuthentication != 0 {
+		if len(data) < authTagSize {
+			return nil, fmt.Errorf("ciphered content too short")
+		}
+		tag = data[len(data)-authTagSize:]
+		data = data[:len(data)-authTagSize]
+	}
+
+	if security&securityEncryption != 0 && d.EncryptionKey == nil {
+		return nil, fmt.Errorf("%w: frame is encrypted but no encryption key is given", ErrDecryption)
+	}
+	if d.EncryptionKey == nil {
+		// Authenticated only, the tag cannot be verified without the
+		// encryption key
+		return data, nil
+	}
+
+	block, err := aes.NewCipher(d.EncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecryption, err)
+	}
+
+	nonce := make([]byte, 12)
+	copy(nonce, systemTitle)
+	binary.BigEndian.PutUint32(nonce[8:], frameCounter)
+
+	if tag != nil && d.AuthenticationKey != nil {
+		gcm, err := cipher.NewGCMWithTagSize(block, authTagSize)
+		if err != nil {
+			return nil, err
+		}
+
+		// The additional data is the security control byte and the
+		// authentication key, followed by the APDU if it is not encrypted
+		aad := append([]byte{security}, d.AuthenticationKey...)
+		sealed := append(append([]byte(nil), data...), tag...)
+		if security&securityEncryption == 0 {
+			aad = append(aad, data...)
+			sealed = tag
+		}
+
+		plain, err := gcm.Open(nil, nonce, sealed, aad)
+		if err != nil {
+			return nil, fmt.Errorf("%w: authentication failed for frame counter %d, check the encryption and authentication keys", ErrDecryption, frameCounter)
+		}
+		if security&securityEncryption == 0 {
+			return data, nil
+		}
+		return plain, nil
+	}
+
+	if security&securityEncryption == 0 {
+		return data, nil
+	}
+
+	// Without verifying the tag GCM decryption is plain CTR mode, starting
+	// with counter 2 for a 12 byte nonce
+	counter := append(nonce, 0, 0, 0, 2)
+	plain := make([]byte, len(data))
+	cipher.NewCTR(block, counter).XORKeyStream(plain, data)
+
+	// Without authentication a wrong key is only noticed from the content
+	if len(plain) == 0 || plain[0] != tagDataNotification {
+		return nil, fmt.Errorf("%w: decrypted data is not a data-notification, check the encryption key", ErrDecryption)
+	}
+
+	return plain, nil
+}
@@ -0,0 +1,138 @@
+package ams
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/ghostiam/binstruct"
+)
+
+// Keys of the DLMS Green Book test vectors, also used for the encrypted
+// frames in testdata
+var (
+	testEncryptionKey     = mustHex("000102030405060708090a0b0c0d0e0f")
+	testAuthenticationKey = mustHex("d0d1d2d3d4d5d6d7d8d9dadbdcdddedf")
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// withFCS returns frame with its frame check sequence updated, so a change
+// to the information field is not caught by the checksum
+func withFCS(frame []byte) []byte {
+	fcsStart := len(frame) - 3
+	binary.LittleEndian.PutUint16(frame[fcsStart:], crc16X25(frame[1:fcsStart]))
+	return frame
+}
+
+func TestDecrypt(t *testing.T) {
+	// General-glo-ciphering content of the Green Book example: system title
+	// 4d4d4d0000bc614e, security control 0x30, frame counter 01234567,
+	// ciphertext and tag of get-request c0010000080000010000ff0200
+	apdu := mustHex("084d4d4d0000bc614e1e3001234567" +
+		"411312ff935a47566827c467bc" + "7d825c3be4a77c3fcc056b6b")
+	plain := mustHex("c0010000080000010000ff0200")
+
+	tests := []struct {
+		name    string
+		apdu    []byte
+		ek, ak  []byte
+		want    []byte
+		wantErr error
+	}{
+		{"authenticated", apdu, testEncryptionKey, testAuthenticationKey, plain, nil},
+		{"wrong authentication key", apdu, testEncryptionKey, testEncryptionKey, nil, ErrDecryption},
+		{"wrong encryption key", apdu, testAuthenticationKey, testAuthenticationKey, nil, ErrDecryption},
+		{"no key", apdu, nil, nil, nil, ErrDecryption},
+		{"invalid key length", apdu, testEncryptionKey[:5], nil, nil, ErrDecryption},
+		{"corrupted ciphertext", modified(apdu, func(a []byte) []byte { a[20] ^= 0x01; return a }), testEncryptionKey, testAuthenticationKey, nil, ErrDecryption},
+		{"corrupted tag", modified(apdu, func(a []byte) []byte { a[len(a)-1] ^= 0x01; return a }), testEncryptionKey, testAuthenticationKey, nil, ErrDecryption},
+		{"corrupted frame counter", modified(apdu, func(a []byte) []byte { a[14] ^= 0x01; return a }), testEncryptionKey, testAuthenticationKey, nil, ErrDecryption},
+
+		// Without the authentication key the tag is not checked and CTR
+		// mode does not give a data-notification
+		{"not a data-notification", apdu, testEncryptionKey, nil, nil, ErrDecryption},
+
+		{"compressed", modified(apdu, func(a []byte) []byte { a[10] |= 0x80; return a }), testEncryptionKey, testAuthenticationKey, nil, ErrUnsupported},
+		{"system title length", mustHex("044d4d4d00053001234567aa"), testEncryptionKey, nil, nil, ErrUnsupported},
+		{"truncated", apdu[:len(apdu)-5], testEncryptionKey, testAuthenticationKey, nil, nil},
+		{"content too short", mustHex("084d4d4d0000bc614e03300123"), testEncryptionKey, nil, nil, nil},
+		{"tag too short", mustHex("084d4d4d0000bc614e0a30012345670102030405"), testEncryptionKey, testAuthenticationKey, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Decoder{EncryptionKey: tt.ek, AuthenticationKey: tt.ak}
+			got, err := d.decrypt(binstruct.NewReaderFromBytes(tt.apdu, binary.BigEndian, false))
+
+			if tt.want != nil {
+				if err != nil || !bytes.Equal(got, tt.want) {
+					t.Errorf("decrypt() = %x, %v, want %x", got, err, tt.want)
+				}
+				return
+			}
+			// Truncated content only needs to fail
+			if err == nil || tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("decrypt() = %x, %v, want error %v", got, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeEncrypted(t *testing.T) {
+	// The frames carry the APDU of kamstrup_list2, authenticated and
+	// encrypted or only encrypted
+	gcm := readFrame(t, "kamstrup_gcm")
+	encOnly := readFrame(t, "kamstrup_gcm_enc_only")
+
+	tests := []struct {
+		name    string
+		frame   []byte
+		ek, ak  []byte
+		wantErr error
+	}{
+		{"encryption and authentication key", gcm, testEncryptionKey, testAuthenticationKey, nil},
+		{"encryption key only", gcm, testEncryptionKey, nil, nil},
+		{"no key", gcm, nil, nil, ErrDecryption},
+		{"authentication key only", gcm, nil, testAuthenticationKey, ErrDecryption},
+		{"wrong encryption key", gcm, testAuthenticationKey, testAuthenticationKey, ErrDecryption},
+		{"wrong authentication key", gcm, testEncryptionKey, testEncryptionKey, ErrDecryption},
+		{"wrong encryption key without authentication", gcm, testAuthenticationKey, nil, ErrDecryption},
+		{"corrupted", withFCS(modified(gcm, func(f []byte) []byte { f[40] ^= 0x01; return f })), testEncryptionKey, testAuthenticationKey, ErrDecryption},
+		{"encrypted only", encOnly, testEncryptionKey, nil, nil},
+		{"encrypted only, authentication key ignored", encOnly, testEncryptionKey, testAuthenticationKey, nil},
+		{"encrypted only, no key", encOnly, nil, nil, ErrDecryption},
+		{"encrypted only, wrong key", encOnly, testAuthenticationKey, nil, ErrDecryption},
+	}
+
+	want, err := Decode(readFrame(t, "kamstrup_list2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Decoder{EncryptionKey: tt.ek, AuthenticationKey: tt.ak}
+			reading, err := d.Decode(tt.frame)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Decode() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if reading.MeterID != want.MeterID || reading.Clock != want.Clock ||
+				reading.ActivePowerPlus != want.ActivePowerPlus || reading.L3Voltage != want.L3Voltage {
+				t.Errorf("Decode() = %+v, want %+v", reading, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package ams
+
+import (
+	"errors"
+	"time"
+)
+
+// Clock status bits, IEC 62056-6-2
+const (
+	ClockInvalid          = 0x01
+	ClockDoubtful         = 0x02
+	ClockDifferentBase    = 0x04
+	ClockInvalidStatus    = 0x08
+	ClockDaylightSavingOn = 0x80
+)
+
+// deviationUnspecified is sent when the meter does not know its deviation
+// from UTC
+const deviationUnspecified = 0x8000
+
+var (
+	// ErrClockUnset is returned by DateTime.Time when the meter did not send
+	// a complete date and time.
+	ErrClockUnset = errors.New("ams: clock not set")
+
+	// ErrClockInvalid is returned by DateTime.Time when the clock status
+	// marks the time as invalid.
+	ErrClockInvalid = errors.New("ams: clock invalid")
+)
+
+// Time converts the meter clock to a time.Time. The deviation sent by the
+// meter is the number of minutes local time is behind UTC. When the meter
+// does not send it, the time is taken as local time in loc, using the
+// daylight saving flag to pick the right time in the hour that repeats when
+// daylight saving ends.
+func (dt DateTime) Time(loc *time.Location) (time.Time, error) {
+	if dt.Year == 0 || dt.Year == 0xffff || dt.Month == 0 || dt.Month > 12 ||
+		dt.Day == 0 || dt.Day > 31 || dt.Hour > 23 || dt.Minute > 59 || dt.Second > 59 {
+		return time.Time{}, ErrClockUnset
+	}
+	if dt.ClockStatus != 0xff && dt.ClockStatus&(ClockInvalid|ClockInvalidStatus) != 0 {
+		return time.Time{}, ErrClockInvalid
+	}
+
+	var nsec int
+	if dt.Hundreds < 100 {
+		nsec = int(dt.Hundreds) * int(10*time.Millisecond)
+	}
+
+	if dt.Deviation != deviationUnspecified {
+		deviation := int(int16(dt.Deviation))
+		loc = time.FixedZone("", -deviation*60)
+	}
+
+	t := time.Date(int(dt.Year), time.Month(dt.Month), int(dt.Day),
+		int(dt.Hour), int(dt.Minute), int(dt.Second), nsec, loc)
+
+	// In the hour repeated when daylight saving ends the wall clock is
+	// ambiguous, take the time matching the daylight saving flag
+	if dst := dt.ClockStatus&ClockDaylightSavingOn != 0; dt.Deviation == deviationUnspecified &&
+		dt.ClockStatus != 0xff && t.IsDST() != dst {
+		for _, alt := range []time.Time{t.Add(-time.Hour), t.Add(time.Hour)} {
+			if alt.IsDST() == dst && alt.Hour() == t.Hour() && alt.Minute() == t.Minute() {
+				return alt, nil
+			}
+		}
+	}
+
+	return t, nil
+}
+
+// Time returns the time of the reading, from the clock in the notification
+// header or, for meters that leave it out, the meter clock register.
+func (r *Reading) Time(loc *time.Location) (time.Time, error) {
+	t, err := r.Clock.Time(loc)
+	if errors.Is(err, ErrClockUnset) {
+		return r.MeterClock.Time(loc)
+	}
+
+	return t, err
+}
@@ -0,0 +1,122 @@
+package ams
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDateTimeTime(t *testing.T) {
+	oslo, err := time.LoadLocation("Europe/Oslo")
+	if err != nil {
+		t.Skipf("no time zone database: %v", err)
+	}
+
+	// date returns a DateTime with the given wall clock, deviation and status
+	date := func(year uint16, month, day, hour, minute uint8, deviation uint16, status uint8) DateTime {
+		return DateTime{Year: year, Month: month, Day: day, Hour: hour, Minute: minute, Hundreds: 0xff, Deviation: deviation, ClockStatus: status}
+	}
+	utc := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2022, month, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name    string
+		dt      DateTime
+		want    time.Time
+		wantErr error
+	}{
+		// The deviation is the number of minutes local time is behind UTC
+		{"deviation ahead of UTC", date(2022, 10, 17, 10, 0, 0xffc4, 0x00), utc(10, 17, 9, 0), nil},
+		{"deviation ahead of UTC in summer", date(2022, 7, 1, 12, 0, 0xff88, 0x80), utc(7, 1, 10, 0), nil},
+		{"deviation behind UTC", date(2022, 10, 17, 10, 0, 0x003c, 0x00), utc(10, 17, 11, 0), nil},
+		{"no deviation", date(2022, 10, 17, 10, 0, 0x0000, 0x00), utc(10, 17, 10, 0), nil},
+		{"deviation wins over location", date(2022, 7, 1, 12, 0, 0xffc4, 0x00), utc(7, 1, 11, 0), nil},
+
+		// Without deviation the time is local time in the location
+		{"unspecified deviation in winter", date(2022, 1, 10, 10, 0, deviationUnspecified, 0x00), utc(1, 10, 9, 0), nil},
+		{"unspecified deviation in summer", date(2022, 7, 1, 12, 0, deviationUnspecified, 0x80), utc(7, 1, 10, 0), nil},
+
+		// 02:30 is repeated on 30 October, first in summer time, then in
+		// winter time
+		{"repeated hour in summer time", date(2022, 10, 30, 2, 30, deviationUnspecified, 0x80), utc(10, 30, 0, 30), nil},
+		{"repeated hour in winter time", date(2022, 10, 30, 2, 30, deviationUnspecified, 0x00), utc(10, 30, 1, 30), nil},
+		{"repeated hour with deviation", date(2022, 10, 30, 2, 30, 0xff88, 0x00), utc(10, 30, 0, 30), nil},
+		{"hour after the repeated one", date(2022, 10, 30, 3, 30, deviationUnspecified, 0x80), utc(10, 30, 2, 30), nil},
+
+		// 02:30 is skipped on 27 March
+		{"skipped hour", date(2022, 3, 27, 2, 30, deviationUnspecified, 0x80), utc(3, 27, 1, 30), nil},
+		{"hour before the skipped one", date(2022, 3, 27, 1, 30, deviationUnspecified, 0x00), utc(3, 27, 0, 30), nil},
+		{"hour after the skipped one", date(2022, 3, 27, 3, 30, deviationUnspecified, 0x80), utc(3, 27, 1, 30), nil},
+
+		// A status of 0xff is not specified, the daylight saving flag is not
+		// used
+		{"unspecified status", date(2022, 1, 10, 10, 0, deviationUnspecified, 0xff), utc(1, 10, 9, 0), nil},
+		{"unspecified status in summer", date(2022, 7, 1, 12, 0, deviationUnspecified, 0xff), utc(7, 1, 10, 0), nil},
+		{"unspecified status with deviation", date(2022, 10, 17, 10, 0, 0xffc4, 0xff), utc(10, 17, 9, 0), nil},
+		{"doubtful", date(2022, 10, 17, 10, 0, 0xffc4, ClockDoubtful), utc(10, 17, 9, 0), nil},
+		{"daylight saving flag wrong for the date", date(2022, 1, 10, 10, 0, deviationUnspecified, 0x80), utc(1, 10, 9, 0), nil},
+
+		{"invalid", date(2022, 10, 17, 10, 0, 0xffc4, ClockInvalid), time.Time{}, ErrClockInvalid},
+		{"invalid status", date(2022, 10, 17, 10, 0, 0xffc4, ClockInvalidStatus|ClockDaylightSavingOn), time.Time{}, ErrClockInvalid},
+		{"year not specified", date(0xffff, 10, 17, 10, 0, 0xffc4, 0x00), time.Time{}, ErrClockUnset},
+		{"all zero", DateTime{}, time.Time{}, ErrClockUnset},
+		{"hour out of range", date(2022, 10, 17, 24, 0, 0xffc4, 0x00), time.Time{}, ErrClockUnset},
+		{"month not specified", date(2022, 0xff, 17, 10, 0, 0xffc4, 0x00), time.Time{}, ErrClockUnset},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.dt.Time(oslo)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Time() error = %v, want %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("Time() = %v, want %v", got.UTC(), tt.want)
+			}
+		})
+	}
+}
+
+func TestDateTimeHundreds(t *testing.T) {
+	dt := DateTime{Year: 2022, Month: 10, Day: 17, Hour: 10, Second: 5, Hundreds: 25, Deviation: 0, ClockStatus: 0xff}
+
+	want := time.Date(2022, 10, 17, 10, 0, 5, 250*int(time.Millisecond), time.UTC)
+	if got, err := dt.Time(time.UTC); err != nil || !got.Equal(want) {
+		t.Errorf("Time() = %v, %v, want %v", got, err, want)
+	}
+
+	// 0xff is not specified
+	dt.Hundreds = 0xff
+	if got, _ := dt.Time(time.UTC); got.Nanosecond() != 0 {
+		t.Errorf("Time() = %v, want whole seconds", got)
+	}
+}
+
+func TestReadingTime(t *testing.T) {
+	clock := DateTime{Year: 2022, Month: 10, Day: 17, Hour: 10, Hundreds: 0xff, Deviation: 0xffc4}
+	want := time.Date(2022, 10, 17, 9, 0, 0, 0, time.UTC)
+
+	// Without the clock in the header, the meter clock register is used
+	tests := []struct {
+		name    string
+		reading Reading
+		want    time.Time
+		wantErr error
+	}{
+		{"header clock", Reading{Clock: clock}, want, nil},
+		{"meter clock", Reading{MeterClock: clock}, want, nil},
+		{"header clock first", Reading{Clock: clock, MeterClock: DateTime{Year: 2021, Month: 1, Day: 1, Deviation: 0}}, want, nil},
+		{"header clock invalid", Reading{Clock: DateTime{Year: 2022, Month: 10, Day: 17, ClockStatus: ClockInvalid}, MeterClock: clock}, time.Time{}, ErrClockInvalid},
+		{"no clock", Reading{}, time.Time{}, ErrClockUnset},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.reading.Time(time.UTC)
+			if !errors.Is(err, tt.wantErr) || !got.Equal(tt.want) {
+				t.Errorf("Time() = %v, %v, want %v, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,20 @@
+package ams
+
+// crc16X25 calculates the CRC-16/X.25 checksum used for the HDLC header
+// check sequence (HCS) and frame check sequence (FCS).
+func crc16X25(data []byte) uint16 {
+	crc := uint16(0xffff)
+
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&0x0001 != 0 {
+				crc = (crc >> 1) ^ 0x8408
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+
+	return ^crc
+}
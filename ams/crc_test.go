@@ -0,0 +1,21 @@
+package ams
+
+import "testing"
+
+func TestCRC16X25(t *testing.T) {
+	tests := []struct {
+		data string
+		want uint16
+	}{
+		// Check value of the CRC-16/X.25 catalogue entry
+		{"123456789", 0x906e},
+		{"", 0x0000},
+		{"\x00", 0xf078},
+	}
+
+	for _, tt := range tests {
+		if got := crc16X25([]byte(tt.data)); got != tt.want {
+			t.Errorf("crc16X25(%q) = %04x, want %04x", tt.data, got, tt.want)
+		}
+	}
+}
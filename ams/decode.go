@@ -0,0 +1,205 @@
+package ams
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ghostiam/binstruct"
+)
+
+// Data-notification APDU tag
+const tagDataNotification = 0x0f
+
+// Decoder decodes frames that may be encrypted with DLMS general-glo-ciphering
+// (AES-128-GCM). The zero value decodes unencrypted frames only.
+type Decoder struct {
+	// EncryptionKey is the 16 byte global unicast encryption key of the meter.
+	EncryptionKey []byte
+
+	// AuthenticationKey is the 16 byte authentication key of the meter. It is
+	// optional; when given, the authentication tag of frames is verified.
+	AuthenticationKey []byte
+}
+
+// Decode decodes a complete HDLC frame, including start and end flags, as
+// returned by Deframer.Next. Encrypted frames are rejected with
+// ErrDecryption.
+func Decode(frame []byte) (*Reading, error) {
+	return new(Decoder).Decode(frame)
+}
+
+// Decode decodes a complete HDLC frame like the package function Decode,
+// decrypting the frame if it is encrypted.
+func (d *Decoder) Decode(frame []byte) (*Reading, error) {
+	reader := binstruct.NewReaderFromBytes(frame, binary.BigEndian, false)
+
+	// Frame start flag
+	if flag, _ := reader.ReadUint8(); flag != hdlcFlag {
+		return nil, fmt.Errorf("%w: invalid frame start flag", ErrInvalidFrame)
+	}
+
+	// Frame format: 4 bits frame type, 1 bit segmentation, 11 bits frame length.
+	// The length excludes the start and end flags.
+	format, err := reader.ReadUint16()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidFrame, err)
+	}
+	if format>>12 != 0xa {
+		return nil, fmt.Errorf("%w: invalid frame format %04x", ErrInvalidFrame, format)
+	}
+	frameLength := int(format & 0x7ff)
+	if frameLength+2 != len(frame) {
+		return nil, fmt.Errorf("%w: frame length %d does not match %d bytes received", ErrInvalidFrame, frameLength, len(frame))
+	}
+
+	// Frame end flag
+	if frame[len(frame)-1] != hdlcFlag {
+		return nil, fmt.Errorf("%w: invalid frame end flag %02x", ErrInvalidFrame, frame[len(frame)-1])
+	}
+
+	// Destination and source address
+	for i := 0; i < 2; i++ {
+		if _, err := readAddress(reader); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidFrame, err)
+		}
+	}
+
+	// Control field
+	if _, err := reader.ReadUint8(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidFrame, err)
+	}
+
+	// Header check sequence, covering everything between the start flag and the HCS
+	headerEnd, err := reader.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	_, b, err := reader.ReadBytes(2)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidFrame, err)
+	}
+	if hcs := binary.LittleEndian.Uint16(b); hcs != crc16X25(frame[1:headerEnd]) {
+		return nil, fmt.Errorf("%w: invalid header check sequence %04x", ErrChecksum, hcs)
+	}
+
+	// Frame check sequence, covering everything between the start flag and
+	// the FCS. A frame without information field has a single check
+	// sequence, which was verified as HCS above.
+	fcsStart := len(frame) - 3
+	if int(headerEnd)+2 > fcsStart {
+		return nil, fmt.Errorf("%w: frame without information field", ErrUnsupported)
+	}
+	if fcs := binary.LittleEndian.Uint16(frame[fcsStart:]); fcs != crc16X25(frame[1:fcsStart]) {
+		return nil, fmt.Errorf("%w: invalid frame check sequence %04x", ErrChecksum, fcs)
+	}
+
+	// Only the information field is left to decode
+	info := binstruct.NewReaderFromBytes(frame[headerEnd+2:fcsStart], binary.BigEndian, false)
+
+	reading, err := d.decodeNotification(info)
+	if errors.Is(err, ErrUnsupported) || errors.Is(err, ErrDecryption) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+
+	return reading, nil
+}
+
+func (d *Decoder) decodeNotification(reader binstruct.Reader) (*Reading, error) {
+	var reading Reading
+
+	// LLC header
+	_, b, err := reader.ReadBytes(3)
+	if err != nil {
+		return nil, err
+	}
+	if hex.EncodeToString(b) != "e6e700" {
+		return nil, fmt.Errorf("%w: LLC header %s", ErrUnsupported, hex.EncodeToString(b))
+	}
+
+	// An encrypted APDU is replaced by its decrypted content
+	tag, err := reader.ReadUint8()
+	if err != nil {
+		return nil, err
+	}
+	if tag == tagGeneralGloCiphering {
+		apdu, err := d.decrypt(reader)
+		if err != nil {
+			return nil, err
+		}
+		reader = binstruct.NewReaderFromBytes(apdu, binary.BigEndian, false)
+		if tag, err = reader.ReadUint8(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Data-notification and long-invoke-id-and-priority
+	if tag != tagDataNotification {
+		return nil, fmt.Errorf("%w: APDU tag %02x", ErrUnsupported, tag)
+	}
+	if _, err := readBytes(reader, 4); err != nil {
+		return nil, err
+	}
+
+	// Optional clock. Some meters send it with an octet-string tag, some
+	// with the length only and some leave it out with a zero length.
+	clockLen, err := reader.ReadUint8()
+	if err != nil {
+		return nil, err
+	}
+	if clockLen == uint8(TypeOctetString) {
+		if clockLen, err = reader.ReadUint8(); err != nil {
+			return nil, err
+		}
+	}
+	if clockLen > 0 {
+		b, err = readBytes(reader, int(clockLen))
+		if err != nil {
+			return nil, err
+		}
+		if err := binstruct.UnmarshalBE(b, &reading.Clock); err != nil {
+			return nil, err
+		}
+	}
+
+	// Notification body
+	body, err := decodeValue(reader, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	reading.ListVersion = listVersion(body)
+
+	p := findProfile(body, reading.ListVersion)
+	if p == nil {
+		return nil, fmt.Errorf("%w: unknown list version %q", ErrUnsupported, reading.ListVersion)
+	}
+	reading.Vendor = p.vendor
+
+	if err := p.decode(body, &reading); err != nil {
+		return nil, err
+	}
+
+	return &reading, nil
+}
+
+// readAddress reads an HDLC address field. The address is variable length,
+// the least significant bit of the last byte is set.
+func readAddress(reader binstruct.Reader) ([]byte, error) {
+	var address []byte
+
+	for {
+		n, err := reader.ReadUint8()
+		if err != nil {
+			return nil, err
+		}
+		address = append(address, n)
+		if n&0x01 == 1 {
+			return address, nil
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package ams
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readFrame returns a frame from testdata, stored in hex
+func readFrame(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", name+".hex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return frame
+}
+
+// modified returns a copy of frame changed by fn
+func modified(frame []byte, fn func(f []byte) []byte) []byte {
+	return fn(append([]byte(nil), frame...))
+}
+
+func TestDecodeFrameChecks(t *testing.T) {
+	frame := readFrame(t, "kamstrup_list2")
+
+	tests := []struct {
+		name  string
+		frame []byte
+		want  error
+	}{
+		{"valid", frame, nil},
+		{"corrupted header", modified(frame, func(f []byte) []byte { f[3] ^= 0x02; return f }), ErrChecksum},
+		{"corrupted HCS", modified(frame, func(f []byte) []byte { f[6] ^= 0xff; return f }), ErrChecksum},
+		{"corrupted data", modified(frame, func(f []byte) []byte { f[40] ^= 0x01; return f }), ErrChecksum},
+		{"corrupted FCS", modified(frame, func(f []byte) []byte { f[len(f)-2] ^= 0x80; return f }), ErrChecksum},
+		{"truncated", frame[:len(frame)-10], ErrInvalidFrame},
+		{"header only", frame[:8], ErrInvalidFrame},
+		{"empty", nil, ErrInvalidFrame},
+		{"no start flag", modified(frame, func(f []byte) []byte { f[0] = 0; return f }), ErrInvalidFrame},
+		{"no end flag", modified(frame, func(f []byte) []byte { f[len(f)-1] = 0; return f }), ErrInvalidFrame},
+		{"frame type", modified(frame, func(f []byte) []byte { f[1] = 0x30 | f[1]&0x0f; return f }), ErrInvalidFrame},
+		{"length", modified(frame, func(f []byte) []byte { f[2]--; return f }), ErrInvalidFrame},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reading, err := Decode(tt.frame)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Decode() error = %v, want %v", err, tt.want)
+			}
+			if tt.want == nil && reading.MeterID != "5706567000000000" {
+				t.Errorf("MeterID = %q", reading.MeterID)
+			}
+		})
+	}
+}
+
+func TestDecodeFrameWithoutInformation(t *testing.T) {
+	// Valid HDLC frame with address, control field and FCS only, as sent
+	// by some meters between notifications
+	frame, _ := hex.DecodeString("7ea00703031384957e")
+
+	// The deframer passes it on
+	var d Deframer
+	d.Write(frame)
+	if got := d.Next(); !bytes.Equal(got, frame) {
+		t.Fatalf("Deframer.Next() = %x, want %x", got, frame)
+	}
+
+	if _, err := Decode(frame); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Decode() error = %v, want %v", err, ErrUnsupported)
+	}
+}
+
+func TestDecodeLists(t *testing.T) {
+	tests := []struct {
+		frame       string
+		vendor      string
+		listVersion string
+		meterID     string
+		present     map[string]float64 // OBIS code to value
+		missing     []string
+	}{
+		{
+			"kamstrup_list2", "Kamstrup", "Kamstrup_V0001", "5706567000000000",
+			map[string]float64{"1.0.1.7.0.255": 1234, "1.0.31.7.0.255": 1.23, "1.0.72.7.0.255": 229},
+			[]string{"1.0.1.8.0.255"},
+		},
+		{
+			"kamstrup_list3", "Kamstrup", "Kamstrup_V0001", "5706567000000000",
+			map[string]float64{"1.0.4.7.0.255": 345, "1.0.1.8.0.255": 10000000, "1.0.4.8.0.255": 30000},
+			nil,
+		},
+		{
+			"aidon_list3", "Aidon", "AIDON_V0001", "7359992890941742",
+			map[string]float64{"1.0.1.7.0.255": 1234, "1.0.31.7.0.255": 1.2, "1.0.32.7.0.255": 230.1, "1.0.1.8.0.255": 1000000},
+			nil,
+		},
+		{
+			"aidon_list1", "Aidon", "", "",
+			map[string]float64{"1.0.1.7.0.255": 1122},
+			[]string{"1.0.2.7.0.255", "1.0.31.7.0.255", "1.0.32.7.0.255", "1.0.1.8.0.255"},
+		},
+		{
+			"kaifa_list3", "Kaifa", "KFM_001", "6970631401234567",
+			map[string]float64{"1.0.1.7.0.255": 1234, "1.0.51.7.0.255": 2.34, "1.0.72.7.0.255": 229.3, "1.0.4.8.0.255": 30000},
+			nil,
+		},
+		{
+			"kaifa_list1", "Kaifa", "", "",
+			map[string]float64{"1.0.1.7.0.255": 1122},
+			[]string{"1.0.2.7.0.255", "1.0.31.7.0.255", "1.0.32.7.0.255", "1.0.1.8.0.255"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.frame, func(t *testing.T) {
+			reading, err := Decode(readFrame(t, tt.frame))
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+
+			if reading.Vendor != tt.vendor || reading.ListVersion != tt.listVersion || reading.MeterID != tt.meterID {
+				t.Errorf("Decode() = vendor %q, list version %q, meter ID %q", reading.Vendor, reading.ListVersion, reading.MeterID)
+			}
+			for obisID, want := range tt.present {
+				if q, ok := reading.Quantity(obisID); !ok || q.Value != want {
+					t.Errorf("Quantity(%s) = %v, %v, want %v", obisID, q, ok, want)
+				}
+			}
+			for _, obisID := range tt.missing {
+				if q, ok := reading.Quantity(obisID); ok {
+					t.Errorf("Quantity(%s) = %v, want missing", obisID, q)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package ams
+
+import "errors"
+
+var (
+	// ErrInvalidFrame is returned when the HDLC framing of a frame is broken.
+	ErrInvalidFrame = errors.New("ams: invalid frame")
+
+	// ErrChecksum is returned when the HCS or FCS of a frame does not match.
+	ErrChecksum = errors.New("ams: checksum mismatch")
+
+	// ErrUnsupported is returned for frames that are valid HDLC but do not
+	// carry a data-notification this package understands.
+	ErrUnsupported = errors.New("ams: unsupported data")
+
+	// ErrMalformed is returned when the data-notification content cannot be
+	// decoded, for example because it is truncated or has unexpected types.
+	ErrMalformed = errors.New("ams: malformed data")
+
+	// ErrDecryption is returned for encrypted frames when no key is given or
+	// the frame cannot be decrypted or authenticated with the given keys.
+	ErrDecryption = errors.New("ams: decryption failed")
+)
@@ -0,0 +1,79 @@
+package ams
+
+import "bytes"
+
+const hdlcFlag = 0x7e
+
+// Deframer cuts complete HDLC frames out of a byte stream. The frame length is
+// taken from the frame format field. Bytes that do not belong to a valid frame
+// are discarded until the next flag is found.
+//
+// The zero value is ready to use.
+type Deframer struct {
+	buf       []byte
+	discarded int
+}
+
+// Write adds data received from the stream. It never fails.
+func (d *Deframer) Write(data []byte) (int, error) {
+	d.buf = append(d.buf, data...)
+	return len(data), nil
+}
+
+// Next returns the next complete frame, including start and end flags, or nil
+// if more data is needed.
+func (d *Deframer) Next() []byte {
+	for {
+		start := bytes.IndexByte(d.buf, hdlcFlag)
+		if start < 0 {
+			d.discarded += len(d.buf)
+			d.buf = d.buf[:0]
+			return nil
+		}
+		d.discarded += start
+		d.buf = d.buf[start:]
+
+		// Flag and frame format field
+		if len(d.buf) < 3 {
+			return nil
+		}
+
+		// Frame format: 4 bits frame type, 1 bit segmentation, 11 bits frame
+		// length. Anything else means this flag was an end flag or garbage.
+		format := uint16(d.buf[1])<<8 | uint16(d.buf[2])
+		if format>>12 != 0xa {
+			d.skip()
+			continue
+		}
+
+		frameLength := int(format & 0x7ff)
+		if len(d.buf) < frameLength+2 {
+			return nil
+		}
+		if d.buf[frameLength+1] != hdlcFlag {
+			d.discarded++
+			d.skip()
+			continue
+		}
+
+		frame := make([]byte, frameLength+2)
+		copy(frame, d.buf)
+
+		// The end flag may also be the start flag of the next frame
+		d.buf = d.buf[frameLength+1:]
+
+		return frame
+	}
+}
+
+// Discarded returns the number of bytes skipped while resynchronising since
+// the last call and resets the count.
+func (d *Deframer) Discarded() int {
+	n := d.discarded
+	d.discarded = 0
+	return n
+}
+
+func (d *Deframer) skip() {
+	d.buf = d.buf[1:]
+}
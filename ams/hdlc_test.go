@@ -0,0 +1,95 @@
+package ams
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDeframer(t *testing.T) {
+	list2 := readFrame(t, "kamstrup_list2")
+	list3 := readFrame(t, "kamstrup_list3")
+	corrupted := modified(list2, func(f []byte) []byte { f[2] += 4; return f })
+
+	tests := []struct {
+		name      string
+		stream    [][]byte
+		want      [][]byte
+		discarded int
+	}{
+		{"single frame", [][]byte{list2}, [][]byte{list2}, 0},
+		{"consecutive frames", [][]byte{list2, list3}, [][]byte{list2, list3}, 0},
+		{"shared flag", [][]byte{list2, list3[1:]}, [][]byte{list2, list3}, 0},
+		{"garbage before frame", [][]byte{{0x00, 0x13, 0xff}, list2}, [][]byte{list2}, 3},
+		{"garbage between frames", [][]byte{list2, {0x55, 0xaa}, list3}, [][]byte{list2, list3}, 2},
+		// Flags between frames are fill, not discarded data
+		{"repeated flags", [][]byte{{0x7e, 0x7e, 0x7e}, list2}, [][]byte{list2}, 0},
+		{"truncated frame", [][]byte{list3[:100], list2}, [][]byte{list2}, 100},
+		{"wrong length", [][]byte{corrupted, list3}, [][]byte{list3}, len(corrupted) - 1},
+		{"incomplete frame", [][]byte{list2[:len(list2)-1]}, nil, 0},
+		{"garbage only", [][]byte{{0x01, 0x02, 0x03}}, nil, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var d Deframer
+			var frames [][]byte
+			for _, data := range tt.stream {
+				d.Write(data)
+				for frame := d.Next(); frame != nil; frame = d.Next() {
+					frames = append(frames, frame)
+				}
+			}
+
+			if len(frames) != len(tt.want) {
+				t.Fatalf("got %d frames, want %d", len(frames), len(tt.want))
+			}
+			for i := range frames {
+				if !bytes.Equal(frames[i], tt.want[i]) {
+					t.Errorf("frame %d = %x, want %x", i, frames[i], tt.want[i])
+				}
+			}
+			if n := d.Discarded(); n != tt.discarded {
+				t.Errorf("Discarded() = %d, want %d", n, tt.discarded)
+			}
+		})
+	}
+}
+
+func TestDeframerByteByByte(t *testing.T) {
+	list2 := readFrame(t, "kamstrup_list2")
+	list3 := readFrame(t, "kamstrup_list3")
+	stream := append(append([]byte{0x42}, list2...), list3[1:]...)
+
+	var d Deframer
+	var frames [][]byte
+	for _, b := range stream {
+		d.Write([]byte{b})
+		if frame := d.Next(); frame != nil {
+			frames = append(frames, frame)
+		}
+	}
+
+	if len(frames) != 2 || !bytes.Equal(frames[0], list2) || !bytes.Equal(frames[1], list3) {
+		t.Fatalf("got frames %x", frames)
+	}
+	if n := d.Discarded(); n != 1 {
+		t.Errorf("Discarded() = %d, want 1", n)
+	}
+	if n := d.Discarded(); n != 0 {
+		t.Errorf("Discarded() after reset = %d, want 0", n)
+	}
+}
+
+func TestDeframerDecode(t *testing.T) {
+	// Frames returned by the deframer decode, including the one sharing
+	// its start flag with the end flag of the previous frame
+	var d Deframer
+	d.Write(readFrame(t, "kamstrup_list2"))
+	d.Write(readFrame(t, "kamstrup_list3")[1:])
+
+	for frame := d.Next(); frame != nil; frame = d.Next() {
+		if _, err := Decode(frame); err != nil {
+			t.Errorf("Decode() error = %v", err)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package ams
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// profile decodes the notification body sent by the meters of one vendor.
+type profile struct {
+	vendor string
+	prefix string // list version identifier prefix
+	decode func(body Value, reading *Reading) error
+}
+
+var profiles = []profile{
+	{vendor: "Kamstrup", prefix: "Kamstrup_", decode: decodeKamstrup},
+	{vendor: "Aidon", prefix: "AIDON_", decode: decodeAidon},
+	{vendor: "Kaifa", prefix: "KFM_", decode: decodeKaifa},
+}
+
+// aidonVersionID is the OBIS code Aidon sends the list version identifier as.
+const aidonVersionID = "1.0.0.2.129.255"
+
+// listVersion returns the list version identifier. Kamstrup and Kaifa send it
+// as the first element of a structure, Aidon as a register in an array.
+func listVersion(body Value) string {
+	switch body.Type {
+	case TypeStructure:
+		if len(body.Elements) > 0 {
+			version, _ := body.Elements[0].Text()
+			return version
+		}
+	case TypeArray:
+		for _, element := range body.Elements {
+			obisID, value, _, err := registerStructure(element)
+			if err == nil && obisID == aidonVersionID {
+				version, _ := value.Text()
+				return version
+			}
+		}
+	}
+
+	return ""
+}
+
+func findProfile(body Value, version string) *profile {
+	for i := range profiles {
+		if strings.HasPrefix(version, profiles[i].prefix) {
+			return &profiles[i]
+		}
+	}
+
+	// The Aidon list with active power only does not carry a version
+	// identifier, but Aidon is the only vendor sending an array.
+	if version == "" && body.Type == TypeArray {
+		return &profiles[1]
+	}
+
+	// Neither does the Kaifa list with active power only, a structure
+	// holding just the value
+	if version == "" && body.Type == TypeStructure && len(body.Elements) == 1 {
+		if _, ok := body.Elements[0].Number(); ok {
+			return &profiles[2]
+		}
+	}
+
+	return nil
+}
+
+// decodeKamstrup decodes a structure with the version identifier followed by
+// pairs of OBIS identifier and value.
+func decodeKamstrup(body Value, reading *Reading) error {
+	if body.Type != TypeStructure {
+		return fmt.Errorf("unexpected notification body %v", body)
+	}
+
+	registers := body.Elements[1:]
+	for i := 0; i+1 < len(registers); i += 2 {
+		obisID, err := obisValue(registers[i])
+		if err != nil {
+			return err
+		}
+
+		if err := decodeRegister(obisID, registers[i+1], nil, reading); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decodeAidon decodes an array of register structures, each holding the OBIS
+// identifier, the value and for numeric values a structure of scaler and unit.
+func decodeAidon(body Value, reading *Reading) error {
+	if body.Type != TypeArray {
+		return fmt.Errorf("unexpected notification body %v", body)
+	}
+
+	for _, element := range body.Elements {
+		obisID, value, su, err := registerStructure(element)
+		if err != nil {
+			return err
+		}
+
+		if err := decodeRegister(obisID, value, su, reading); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// registerStructure returns the content of a register structure. The scaler
+// and unit are nil when the meter does not send them.
+func registerStructure(element Value) (string, Value, *scalerUnit, error) {
+	if element.Type != TypeStructure || len(element.Elements) < 2 {
+		return "", Value{}, nil, fmt.Errorf("unexpected register %v", element)
+	}
+
+	obisID, err := obisValue(element.Elements[0])
+	if err != nil {
+		return "", Value{}, nil, err
+	}
+	if len(element.Elements) == 2 {
+		return obisID, element.Elements[1], nil, nil
+	}
+
+	su := element.Elements[2]
+	if su.Type != TypeStructure || len(su.Elements) != 2 {
+		return "", Value{}, nil, fmt.Errorf("unexpected scaler and unit %v for OBIS ID %s", su, obisID)
+	}
+	scaler, ok := su.Elements[0].Integer()
+	if !ok {
+		return "", Value{}, nil, fmt.Errorf("unexpected scaler %v for OBIS ID %s", su.Elements[0], obisID)
+	}
+	unitCode, _ := su.Elements[1].Integer()
+	unit, ok := cosemUnits[unitCode]
+	if !ok {
+		unit = Unit("unit " + strconv.FormatInt(unitCode, 10))
+	}
+
+	return obisID, element.Elements[1], &scalerUnit{int(scaler), unit}, nil
+}
+
+// kaifaRegister is the OBIS identifier and implicit scaler of a value in a
+// Kaifa list, which carries the values by position only. Currents are sent
+// in mA and voltages in tenths of a volt.
+type kaifaRegister struct {
+	obisID string
+	scaler int
+}
+
+// kaifaLists are the Kaifa lists by number of values, without the version
+// identifier
+var kaifaLists = map[int][]kaifaRegister{
+	// Active power only, sent without version identifier
+	1: {{"1.0.1.7.0.255", 0}},
+	// Single phase
+	8: {
+		{"1.0.0.0.5.255", 0}, {"1.0.96.1.1.255", 0},
+		{"1.0.1.7.0.255", 0}, {"1.0.2.7.0.255", 0}, {"1.0.3.7.0.255", 0}, {"1.0.4.7.0.255", 0},
+		{"1.0.31.7.0.255", -3}, {"1.0.32.7.0.255", -1},
+	},
+	13: {
+		{"1.0.0.0.5.255", 0}, {"1.0.96.1.1.255", 0},
+		{"1.0.1.7.0.255", 0}, {"1.0.2.7.0.255", 0}, {"1.0.3.7.0.255", 0}, {"1.0.4.7.0.255", 0},
+		{"1.0.31.7.0.255", -3}, {"1.0.32.7.0.255", -1},
+		{"0.0.1.0.0.255", 0},
+		{"1.0.1.8.0.255", 0}, {"1.0.2.8.0.255", 0}, {"1.0.3.8.0.255", 0}, {"1.0.4.8.0.255", 0},
+	},
+	// Three phase
+	12: {
+		{"1.0.0.0.5.255", 0}, {"1.0.96.1.1.255", 0},
+		{"1.0.1.7.0.255", 0}, {"1.0.2.7.0.255", 0}, {"1.0.3.7.0.255", 0}, {"1.0.4.7.0.255", 0},
+		{"1.0.31.7.0.255", -3}, {"1.0.51.7.0.255", -3}, {"1.0.71.7.0.255", -3},
+		{"1.0.32.7.0.255", -1}, {"1.0.52.7.0.255", -1}, {"1.0.72.7.0.255", -1},
+	},
+	17: {
+		{"1.0.0.0.5.255", 0}, {"1.0.96.1.1.255", 0},
+		{"1.0.1.7.0.255", 0}, {"1.0.2.7.0.255", 0}, {"1.0.3.7.0.255", 0}, {"1.0.4.7.0.255", 0},
+		{"1.0.31.7.0.255", -3}, {"1.0.51.7.0.255", -3}, {"1.0.71.7.0.255", -3},
+		{"1.0.32.7.0.255", -1}, {"1.0.52.7.0.255", -1}, {"1.0.72.7.0.255", -1},
+		{"0.0.1.0.0.255", 0},
+		{"1.0.1.8.0.255", 0}, {"1.0.2.8.0.255", 0}, {"1.0.3.8.0.255", 0}, {"1.0.4.8.0.255", 0},
+	},
+}
+
+// decodeKaifa decodes a structure with the version identifier followed by the
+// values in a fixed order depending on the list, or holding the active power
+// only.
+func decodeKaifa(body Value, reading *Reading) error {
+	if body.Type != TypeStructure {
+		return fmt.Errorf("unexpected notification body %v", body)
+	}
+	values := body.Elements
+	if reading.ListVersion != "" {
+		values = values[1:]
+	}
+	list, ok := kaifaLists[len(values)]
+	if !ok {
+		return fmt.Errorf("unexpected notification body %v", body)
+	}
+
+	for i, kr := range list {
+		su := &scalerUnit{kr.scaler, registers[kr.obisID].unit}
+		if err := decodeRegister(kr.obisID, values[i], su, reading); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// obisValue returns the OBIS identifier sent as octet-string, formatted as
+// A.B.C.D.E.F. The B group is the channel, which vendors set differently for
+// the same register, so it is always returned as 0.
+func obisValue(value Value) (string, error) {
+	if value.Type != TypeOctetString || len(value.Bytes) != 6 {
+		return "", fmt.Errorf("unexpected OBIS identifier %v", value)
+	}
+
+	parts := make([]string, len(value.Bytes))
+	for i, n := range value.Bytes {
+		parts[i] = strconv.Itoa(int(n))
+	}
+	parts[1] = "0"
+
+	return strings.Join(parts, "."), nil
+}
+
+// decodeRegister stores the value of a register in the reading. Numeric
+// values are scaled with su, or the default of the register table if nil.
+func decodeRegister(obisID string, value Value, su *scalerUnit, reading *Reading) error {
+	var ok bool
+
+	switch obisID {
+	case aidonVersionID:
+		ok = true
+	case "1.0.0.0.5.255", "0.0.96.1.0.255": // Meter ID
+		reading.MeterID, ok = value.Text()
+	case "1.0.96.1.1.255", "0.0.96.1.7.255": // Meter type
+		reading.MeterType, ok = value.Text()
+	case "0.0.1.0.0.255": // Meter clock
+		reading.MeterClock, ok = value.DateTime()
+	default:
+		reg, found := registers[obisID]
+		if !found {
+			raw := RawRegister{OBIS: obisID, Value: value}
+			if su != nil {
+				raw.Scaler, raw.Unit = su.scaler, su.unit
+			}
+			reading.Unknown = append(reading.Unknown, raw)
+			return nil
+		}
+		if su == nil {
+			su = &reg.scalerUnit
+		}
+
+		var n float64
+		if n, ok = value.Number(); !ok {
+			break
+		}
+		*reg.quantity(reading) = Quantity{Value: Scale(n, su.scaler), Unit: su.unit}
+		if reading.present == nil {
+			reading.present = make(map[string]bool)
+		}
+		reading.present[obisID] = true
+		if isEnergy(obisID) {
+			reading.HasEnergy = true
+		}
+	}
+
+	if !ok {
+		return fmt.Errorf("unexpected value %v for OBIS ID %s", value, obisID)
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+package ams
+
+import (
+	"math"
+	"strconv"
+)
+
+// Unit is the physical unit of a Quantity.
+type Unit string
+
+// Units of the registers sent by AMS meters. Values are always in the base
+// unit, without prefix.
+const (
+	UnitNone        Unit = ""
+	UnitWatt        Unit = "W"
+	UnitVoltAmpere  Unit = "VA"
+	UnitVar         Unit = "var"
+	UnitWattHour    Unit = "Wh"
+	UnitVoltAmpHour Unit = "VAh"
+	UnitVarHour     Unit = "varh"
+	UnitAmpere      Unit = "A"
+	UnitVolt        Unit = "V"
+	UnitHertz       Unit = "Hz"
+)
+
+// cosemUnits maps the COSEM unit enumeration, IEC 62056-6-2, to Unit.
+var cosemUnits = map[int64]Unit{
+	27:  UnitWatt,
+	28:  UnitVoltAmpere,
+	29:  UnitVar,
+	30:  UnitWattHour,
+	31:  UnitVoltAmpHour,
+	32:  UnitVarHour,
+	33:  UnitAmpere,
+	35:  UnitVolt,
+	44:  UnitHertz,
+	255: UnitNone,
+}
+
+// Quantity is a measured value in the base unit.
+type Quantity struct {
+	Value float64
+	Unit  Unit
+}
+
+func (q Quantity) String() string {
+	s := strconv.FormatFloat(q.Value, 'f', -1, 64)
+	if q.Unit != UnitNone {
+		s += " " + string(q.Unit)
+	}
+
+	return s
+}
+
+// RawRegister is a register sent by the meter that the decoder does not
+// know, such as one added by a firmware update. OBIS is the identifier
+// formatted as A.B.C.D.E.F with B set to 0. Scaler and Unit are only set when
+// the meter sent them with the value.
+type RawRegister struct {
+	OBIS   string
+	Value  Value
+	Scaler int
+	Unit   Unit
+}
+
+// Quantity returns the scaled value of a numeric register.
+func (r RawRegister) Quantity() (Quantity, bool) {
+	n, ok := r.Value.Number()
+	if !ok {
+		return Quantity{}, false
+	}
+
+	return Quantity{Value: Scale(n, r.Scaler), Unit: r.Unit}, true
+}
+
+// scalerUnit is the COSEM scaler and unit of a register value. The value in
+// unit is the sent value multiplied by 10^scaler.
+type scalerUnit struct {
+	scaler int
+	unit   Unit
+}
+
+// register is an entry of the OBIS register table.
+type register struct {
+	name string
+	scalerUnit
+
+	// quantity returns the reading field the register is stored in
+	quantity func(r *Reading) *Quantity
+}
+
+// registers is the OBIS register table. The B group of the OBIS codes is
+// always 0, see obisValue. The scaler is the one used when the meter does
+// not send scaler and unit with the value, which is the Kamstrup convention.
+// Other vendors override it, see the profiles.
+var registers = map[string]register{
+	"1.0.1.7.0.255": {"Active power +", scalerUnit{0, UnitWatt}, func(r *Reading) *Quantity { return &r.ActivePowerPlus }},
+	"1.0.2.7.0.255": {"Active power -", scalerUnit{0, UnitWatt}, func(r *Reading) *Quantity { return &r.ActivePowerMinus }},
+	"1.0.3.7.0.255": {"Reactive power +", scalerUnit{0, UnitVar}, func(r *Reading) *Quantity { return &r.ReactivePowerPlus }},
+	"1.0.4.7.0.255": {"Reactive power -", scalerUnit{0, UnitVar}, func(r *Reading) *Quantity { return &r.ReactivePowerMinus }},
+
+	"1.0.31.7.0.255": {"L1 current", scalerUnit{-2, UnitAmpere}, func(r *Reading) *Quantity { return &r.L1Current }},
+	"1.0.51.7.0.255": {"L2 current", scalerUnit{-2, UnitAmpere}, func(r *Reading) *Quantity { return &r.L2Current }},
+	"1.0.71.7.0.255": {"L3 current", scalerUnit{-2, UnitAmpere}, func(r *Reading) *Quantity { return &r.L3Current }},
+	"1.0.32.7.0.255": {"L1 voltage", scalerUnit{0, UnitVolt}, func(r *Reading) *Quantity { return &r.L1Voltage }},
+	"1.0.52.7.0.255": {"L2 voltage", scalerUnit{0, UnitVolt}, func(r *Reading) *Quantity { return &r.L2Voltage }},
+	"1.0.72.7.0.255": {"L3 voltage", scalerUnit{0, UnitVolt}, func(r *Reading) *Quantity { return &r.L3Voltage }},
+
+	"1.0.1.8.0.255": {"Active energy +", scalerUnit{1, UnitWattHour}, func(r *Reading) *Quantity { return &r.ActiveEnergyPlus }},
+	"1.0.2.8.0.255": {"Active energy -", scalerUnit{1, UnitWattHour}, func(r *Reading) *Quantity { return &r.ActiveEnergyMinus }},
+	"1.0.3.8.0.255": {"Reactive energy +", scalerUnit{1, UnitVarHour}, func(r *Reading) *Quantity { return &r.ReactiveEnergyPlus }},
+	"1.0.4.8.0.255": {"Reactive energy -", scalerUnit{1, UnitVarHour}, func(r *Reading) *Quantity { return &r.ReactiveEnergyMinus }},
+}
+
+// Quantity returns the value of the numeric register with the OBIS code,
+// formatted as A.B.C.D.E.F with B set to 0, from the reading fields or from
+// the unknown registers. Registers are only returned when the frame carried
+// them.
+func (r *Reading) Quantity(obisID string) (Quantity, bool) {
+	if reg, ok := registers[obisID]; ok {
+		if !r.present[obisID] {
+			return Quantity{}, false
+		}
+		return *reg.quantity(r), true
+	}
+
+	for _, raw := range r.Unknown {
+		if raw.OBIS == obisID {
+			return raw.Quantity()
+		}
+	}
+
+	return Quantity{}, false
+}
+
+// Text returns the value of the text register with the OBIS code, such as
+// the meter ID, from the reading fields or from the unknown registers.
+func (r *Reading) Text(obisID string) (string, bool) {
+	switch obisID {
+	case "1.0.0.0.5.255", "0.0.96.1.0.255":
+		return r.MeterID, r.MeterID != ""
+	case "1.0.96.1.1.255", "0.0.96.1.7.255":
+		return r.MeterType, r.MeterType != ""
+	}
+
+	for _, raw := range r.Unknown {
+		if raw.OBIS == obisID {
+			return raw.Value.Text()
+		}
+	}
+
+	return "", false
+}
+
+// isEnergy reports whether the OBIS code is a cumulative energy register
+func isEnergy(obisID string) bool {
+	switch obisID {
+	case "1.0.1.8.0.255", "1.0.2.8.0.255", "1.0.3.8.0.255", "1.0.4.8.0.255":
+		return true
+	}
+
+	return false
+}
+
+// Scale returns value multiplied by 10^scaler. Negative scalers divide by a
+// power of ten, which unlike multiplying by 0.01 keeps 123 * 10^-2 at 1.23.
+func Scale(value float64, scaler int) float64 {
+	if scaler >= 0 {
+		return value * math.Pow10(scaler)
+	}
+
+	return value / math.Pow10(-scaler)
+}
@@ -0,0 +1,24 @@
+package ams
+
+import "testing"
+
+func TestScale(t *testing.T) {
+	tests := []struct {
+		value  float64
+		scaler int
+		want   float64
+	}{
+		{1234, 0, 1234},
+		{123, -2, 1.23},
+		{2301, -1, 230.1},
+		{1000000, 1, 10000000},
+		{5, 3, 5000},
+		{-345, -3, -0.345},
+	}
+
+	for _, tt := range tests {
+		if got := Scale(tt.value, tt.scaler); got != tt.want {
+			t.Errorf("Scale(%v, %d) = %v, want %v", tt.value, tt.scaler, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// archiveSchema identifies the layout of the archive files. It is changed
+// whenever the fixed columns are changed; the field columns follow the OBIS
+// mapping and are listed in the header.
+const archiveSchema = "kamstrup_ams_logger/archive/v2"
+
+// archiveFields returns the fields of the OBIS mapping stored in the
+// archive, in column order. Fields missing from a reading, such as the energy
+// outside the hourly list, are left empty in CSV and null in JSON.
+func archiveFields() []fieldSpec {
+	var fields []fieldSpec
+	for _, f := range mapping.Fields {
+		if f.forwardedTo("archive") {
+			fields = append(fields, f)
+		}
+	}
+
+	return fields
+}
+
+// archiveWriter writes every reading as a CSV row or JSON object to a file
+// in dir. A new file is started every day and, if maxSize is set, when the
+// file grows beyond maxSize bytes. Closed files are optionally compressed.
+//
+// Readings of several meters, replayed readings and readings timestamped
+// with the receive time do not arrive in time order. The day of the file
+// therefore only moves forward: a reading from an earlier day goes to the
+// file of the latest day seen, and a file once closed is not opened again.
+//
+// Every file starts with a header describing the schema: a comment line and
+// the column names for CSV, a schema object for JSON lines.
+type archiveWriter struct {
+	dir      string
+	format   string // csv or json
+	maxSize  int64
+	compress bool
+
+	mu          sync.Mutex
+	file        *os.File
+	day         string
+	index       int // of the file within the day
+	size        int64
+	closed      bool
+	compressing sync.WaitGroup
+}
+
+// errArchiveClosed is returned for readings written after close
+var errArchiveClosed = errors.New("archive closed")
+
+func newArchiveWriter(dir string, format string, maxSize int64, compress bool) (*archiveWriter, error) {
+	if format != "csv" && format != "json" {
+		return nil, fmt.Errorf("unsupported archive format: %s", format)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &archiveWriter{dir: dir, format: format, maxSize: maxSize, compress: compress}, nil
+}
+
+func (a *archiveWriter) name() string {
+	return "archive"
+}
+
+func (a *archiveWriter) write(reading *meterReading, timestamp time.Time) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return errArchiveClosed
+	}
+
+	// The file name sorts like the day, so the latest day is the larger
+	day := timestamp.Local().Format("2006-01-02")
+	if day < a.day {
+		day = a.day
+	}
+	if a.file != nil && (day != a.day || (a.maxSize > 0 && a.size >= a.maxSize)) {
+		a.closeFile()
+	}
+	if a.file == nil {
+		if err := a.open(day); err != nil {
+			return err
+		}
+	}
+
+	values := make(map[string]field)
+	for _, f := range readingFields(reading, "archive") {
+		values[f.name] = f
+	}
+
+	var meterClock string
+	if t, err := reading.Time(location); err == nil {
+		meterClock = t.Format(time.RFC3339)
+	}
+
+	var line []byte
+	if a.format == "csv" {
+		record := []string{timestamp.Format(time.RFC3339), meterClock, reading.MeterID, reading.label, reading.MeterType, reading.ListVersion}
+		for _, f := range archiveFields() {
+			if v, ok := values[f.Name]; ok {
+				record = append(record, v.format())
+			} else {
+				record = append(record, "")
+			}
+		}
+		line = csvLine(record)
+	} else {
+		object := map[string]interface{}{
+			"time":         timestamp.Format(time.RFC3339),
+			"meter_clock":  nil,
+			"meter_id":     reading.MeterID,
+			"label":        reading.label,
+			"meter_type":   reading.MeterType,
+			"list_version": reading.ListVersion,
+		}
+		if meterClock != "" {
+			object["meter_clock"] = meterClock
+		}
+		for _, f := range archiveFields() {
+			if v, ok := values[f.Name]; ok {
+				object[f.Name] = v.jsonValue()
+			} else {
+				object[f.Name] = nil
+			}
+		}
+		var err error
+		if line, err = json.Marshal(object); err != nil {
+			return err
+		}
+		line = append(line, '\n')
+	}
+
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+
+	return err
+}
+
+// open opens the next free file of the day and writes the header to it if
+// it is new. Files of the day closed before are skipped, they may be being
+// compressed. A file left by an earlier run is appended to if it is not
+// full.
+func (a *archiveWriter) open(day string) error {
+	first := 0
+	if day == a.day {
+		first = a.index + 1
+	}
+
+	var name string
+	i := first
+	for ; ; i++ {
+		name = fmt.Sprintf("ams-%s.%s", day, a.format)
+		if i > 0 {
+			name = fmt.Sprintf("ams-%s.%d.%s", day, i, a.format)
+		}
+		name = filepath.Join(a.dir, name)
+
+		// Skip files that are full or already compressed
+		if _, err := os.Stat(name + ".gz"); err == nil {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err == nil && a.maxSize > 0 && info.Size() >= a.maxSize {
+			continue
+		}
+		break
+	}
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	a.file = f
+	a.day = day
+	a.index = i
+	a.size = info.Size()
+
+	if a.size == 0 {
+		n, err := a.file.Write(a.header())
+		a.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (a *archiveWriter) header() []byte {
+	fields := archiveFields()
+	units := make([]string, len(fields))
+	for i, f := range fields {
+		units[i] = f.Name + "=" + f.Unit
+	}
+
+	if a.format == "csv" {
+		columns := []string{"time", "meter_clock", "meter_id", "label", "meter_type", "list_version"}
+		for _, f := range fields {
+			columns = append(columns, f.Name)
+		}
+		comment := fmt.Sprintf("# %s; times in RFC 3339; units: %s\n", archiveSchema, strings.Join(units, " "))
+		return append([]byte(comment), csvLine(columns)...)
+	}
+
+	unitMap := make(map[string]string)
+	for _, f := range fields {
+		unitMap[f.Name] = f.Unit
+	}
+	header, _ := json.Marshal(map[string]interface{}{"schema": archiveSchema, "units": unitMap})
+	return append(header, '\n')
+}
+
+// close closes the current file and waits until the closed files are
+// compressed. Readings written afterwards are rejected.
+func (a *archiveWriter) close() error {
+	a.mu.Lock()
+	if a.file != nil {
+		a.closeFile()
+	}
+	a.closed = true
+	a.mu.Unlock()
+
+	a.compressing.Wait()
+	return nil
+}
+
+// closeFile closes the current file and compresses it in the background
+func (a *archiveWriter) closeFile() {
+	name := a.file.Name()
+	if err := a.file.Close(); err != nil {
+		slog.Error("Error closing archive file", "file", name, "error", err)
+	}
+	a.file = nil
+
+	if a.compress {
+		a.compressing.Add(1)
+		go func() {
+			defer a.compressing.Done()
+			if err := gzipFile(name); err != nil {
+				slog.Error("Error compressing archive file", "file", name, "error", err)
+			}
+		}()
+	}
+}
+
+func csvLine(record []string) []byte {
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	w.Write(record)
+	w.Flush()
+
+	return []byte(b.String())
+}
+
+// gzipFile replaces name with name.gz
+func gzipFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(name + ".gz")
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+
+	return os.Remove(name)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// archiveFiles returns the names of the files in dir
+func archiveFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// archiveLines returns the lines of an archive file, decompressing it if it
+// is compressed
+func archiveLines(t *testing.T, name string) []string {
+	t.Helper()
+
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(name, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return lines
+}
+
+func newTestArchive(t *testing.T, format string, maxSize int64, compress bool) (*archiveWriter, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	a, err := newArchiveWriter(dir, format, maxSize, compress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a, dir
+}
+
+func TestArchiveCSV(t *testing.T) {
+	a, dir := newTestArchive(t, "csv", 0, false)
+	timestamp := time.Date(2022, 10, 17, 10, 0, 0, 0, time.Local)
+
+	for _, frame := range []string{"kamstrup_list2", "kamstrup_list3"} {
+		if err := a.write(testReading(t, frame, "house"), timestamp); err != nil {
+			t.Fatalf("write() error = %v", err)
+		}
+	}
+	a.close()
+
+	lines := archiveLines(t, filepath.Join(dir, "ams-2022-10-17.csv"))
+	if len(lines) != 4 {
+		t.Fatalf("archive has %d lines, want header, columns and 2 rows:\n%s", len(lines), strings.Join(lines, "\n"))
+	}
+	if !strings.HasPrefix(lines[0], "# "+archiveSchema+"; ") || !strings.Contains(lines[0], "active_power_plus=W") {
+		t.Errorf("header = %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "time,meter_clock,meter_id,label,meter_type,list_version,active_power_plus,") {
+		t.Errorf("columns = %q", lines[1])
+	}
+
+	// The energy is left empty outside the hourly list
+	if !strings.HasPrefix(lines[2], timestamp.Format(time.RFC3339)+",2022-10-17T") ||
+		!strings.Contains(lines[2], ",5706567000000000,house,6841121BN243101040,Kamstrup_V0001,1234,") ||
+		!strings.HasSuffix(lines[2], ",,,,") {
+		t.Errorf("list 2 row = %q", lines[2])
+	}
+	if !strings.HasSuffix(lines[3], ",10000000,0,200,30000") {
+		t.Errorf("list 3 row = %q", lines[3])
+	}
+}
+
+func TestArchiveJSON(t *testing.T) {
+	a, dir := newTestArchive(t, "json", 0, false)
+	timestamp := time.Date(2022, 10, 17, 10, 0, 0, 0, time.Local)
+
+	if err := a.write(testReading(t, "kamstrup_list2", ""), timestamp); err != nil {
+		t.Fatalf("write() error = %v", err)
+	}
+	a.close()
+
+	lines := archiveLines(t, filepath.Join(dir, "ams-2022-10-17.json"))
+	if len(lines) != 2 {
+		t.Fatalf("archive has %d lines, want header and 1 row", len(lines))
+	}
+
+	var header struct {
+		Schema string
+		Units  map[string]string
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Schema != archiveSchema || header.Units["active_energy_plus"] != "Wh" {
+		t.Errorf("header = %+v", header)
+	}
+
+	var row map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[1]), &row); err != nil {
+		t.Fatal(err)
+	}
+	if row["meter_id"] != "5706567000000000" || row["active_power_plus"] != 1234.0 || row["l1_current"] != 1.23 {
+		t.Errorf("row = %v", row)
+	}
+	if energy, ok := row["active_energy_plus"]; !ok || energy != nil {
+		t.Errorf("active_energy_plus = %v, %v, want null", energy, ok)
+	}
+}
+
+func TestArchiveDayRotation(t *testing.T) {
+	a, dir := newTestArchive(t, "csv", 0, true)
+	reading := testReading(t, "kamstrup_list2", "")
+
+	// Readings of two meters, one with a clock a few seconds behind,
+	// interleaved across midnight
+	midnight := time.Date(2022, 10, 18, 0, 0, 0, 0, time.Local)
+	for _, offset := range []time.Duration{-10, 5, -5, 10, -2, 15} {
+		if err := a.write(reading, midnight.Add(offset*time.Second)); err != nil {
+			t.Fatalf("write() error = %v", err)
+		}
+	}
+	a.close()
+
+	want := []string{"ams-2022-10-17.csv.gz", "ams-2022-10-18.csv.gz"}
+	if got := archiveFiles(t, dir); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("files = %v, want %v", got, want)
+	}
+
+	// Readings from before midnight that arrive later stay in the new file
+	if n := len(archiveLines(t, filepath.Join(dir, want[0]))) - 2; n != 1 {
+		t.Errorf("%s has %d rows, want 1", want[0], n)
+	}
+	if n := len(archiveLines(t, filepath.Join(dir, want[1]))) - 2; n != 5 {
+		t.Errorf("%s has %d rows, want 5", want[1], n)
+	}
+}
+
+func TestArchiveSizeRotation(t *testing.T) {
+	a, dir := newTestArchive(t, "csv", 1000, true)
+	reading := testReading(t, "kamstrup_list2", "")
+	timestamp := time.Date(2022, 10, 17, 10, 0, 0, 0, time.Local)
+
+	const rows = 20
+	for i := 0; i < rows; i++ {
+		if err := a.write(reading, timestamp.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatalf("write() error = %v", err)
+		}
+	}
+	a.close()
+
+	// Every file is written once, starts with the header and is compressed
+	total := 0
+	files := archiveFiles(t, dir)
+	want := []string{"ams-2022-10-17.csv.gz"}
+	for i := 1; i < len(files); i++ {
+		want = append(want, fmt.Sprintf("ams-2022-10-17.%d.csv.gz", i))
+	}
+	sort.Strings(want)
+	if strings.Join(files, " ") != strings.Join(want, " ") {
+		t.Errorf("files = %v, want %v", files, want)
+	}
+	for _, name := range files {
+		lines := archiveLines(t, filepath.Join(dir, name))
+		if len(lines) < 3 || !strings.HasPrefix(lines[0], "# ") || !strings.HasPrefix(lines[1], "time,") {
+			t.Errorf("%s has no header or no rows", name)
+		}
+		total += len(lines) - 2
+	}
+	if len(files) < 2 || total != rows {
+		t.Errorf("%d rows in %d files, want %d rows in several files", total, len(files), rows)
+	}
+}
+
+func TestArchiveRestart(t *testing.T) {
+	reading := testReading(t, "kamstrup_list2", "")
+	timestamp := time.Date(2022, 10, 17, 10, 0, 0, 0, time.Local)
+
+	// An uncompressed file is appended to, a compressed one is not opened
+	// again
+	for _, compress := range []bool{false, true} {
+		a, dir := newTestArchive(t, "csv", 0, compress)
+		for run := 0; run < 2; run++ {
+			a, _ = newArchiveWriter(dir, "csv", 0, compress)
+			if err := a.write(reading, timestamp); err != nil {
+				t.Fatalf("write() error = %v", err)
+			}
+			a.close()
+		}
+
+		want := []string{"ams-2022-10-17.csv"}
+		if compress {
+			want = []string{"ams-2022-10-17.1.csv.gz", "ams-2022-10-17.csv.gz"}
+		}
+		files := archiveFiles(t, dir)
+		if strings.Join(files, " ") != strings.Join(want, " ") {
+			t.Errorf("compress %v: files = %v, want %v", compress, files, want)
+		}
+		if !compress {
+			if n := len(archiveLines(t, filepath.Join(dir, files[0]))); n != 4 {
+				t.Errorf("appended file has %d lines, want one header and 2 rows", n)
+			}
+		}
+	}
+}
+
+func TestArchiveClose(t *testing.T) {
+	a, dir := newTestArchive(t, "csv", 0, true)
+	reading := testReading(t, "kamstrup_list2", "")
+
+	if err := a.write(reading, time.Now()); err != nil {
+		t.Fatalf("write() error = %v", err)
+	}
+
+	// Closing the sinks compresses the file before returning
+	output := newFanOut([]Sink{a})
+	output.close()
+	files := archiveFiles(t, dir)
+	if len(files) != 1 || !strings.HasSuffix(files[0], ".csv.gz") {
+		t.Errorf("files = %v, want one compressed file", files)
+	}
+
+	if err := a.write(reading, time.Now()); !errors.Is(err, errArchiveClosed) {
+		t.Errorf("write() after close error = %v, want %v", err, errArchiveClosed)
+	}
+}
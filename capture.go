@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Capture files hold one frame per line: the receive time in RFC 3339 with
+// nanoseconds, a space, the complete frame in hex and, for meters with a
+// label, a space and the label. Empty lines and lines starting with # are
+// ignored, so captures can be annotated by hand.
+
+// captureWriter appends every received frame to a capture file. It is
+// shared by all meters.
+type captureWriter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openCapture(name string) (*captureWriter, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &captureWriter{file: f}, nil
+}
+
+// write appends a frame received from the meter with the given label
+func (c *captureWriter) write(label string, frame rawFrame) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	line := frame.received.Format(time.RFC3339Nano) + " " + hex.EncodeToString(frame.data)
+	if label != "" {
+		line += " " + label
+	}
+	_, err := fmt.Fprintln(c.file, line)
+	return err
+}
+
+func (c *captureWriter) close() error {
+	return c.file.Close()
+}
+
+// capturedFrame is a frame read from a capture file with the label of the
+// meter it was received from
+type capturedFrame struct {
+	rawFrame
+	label string
+}
+
+// replay decodes the frames of the capture file given by the configuration
+// and writes every reading to output, waiting for slow sinks instead of
+// dropping readings. The frames of every meter are decoded with the
+// configuration of the meter with their label, each meter in its own
+// goroutine as when reading the devices. It returns when all readings are
+// written.
+func replay(cfg *config, output *fanOut, capture *captureWriter) error {
+	frames := make(chan capturedFrame)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- replayCapture(cfg.Replay, cfg.ReplayRealtime, frames)
+	}()
+
+	output.blocking = true
+	meters := make(map[string]chan rawFrame)
+	var wg sync.WaitGroup
+
+	for frame := range frames {
+		meterFrames, ok := meters[frame.label]
+		if !ok {
+			m := newMeter(cfg.replayMeter(frame.label))
+			meterFrames = make(chan rawFrame)
+			meters[frame.label] = meterFrames
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				processFrames(m.label, &m.decoder, meterFrames, output, capture)
+			}()
+		}
+		meterFrames <- frame.rawFrame
+	}
+
+	for _, meterFrames := range meters {
+		close(meterFrames)
+	}
+	wg.Wait()
+	output.close()
+
+	return <-errc
+}
+
+// replayMeter returns the configuration of the meter whose frames were
+// captured with label. Frames of meters that are not configured, and of
+// captures without labels, are decoded with the top level keys.
+func (c *config) replayMeter(label string) meterConfig {
+	for _, m := range c.meters() {
+		if m.Label == label {
+			return m
+		}
+	}
+
+	m := meterConfig{Label: label, Serial: &c.Serial, EncryptionKey: c.EncryptionKey, AuthenticationKey: c.AuthenticationKey}
+	if label == "" {
+		m.Label = c.Label
+	}
+
+	return m
+}
+
+// replayCapture sends the frames of a capture file on the frames channel and
+// closes it at the end of the file. With realtime set the frames are sent
+// with the delays they were received with.
+func replayCapture(name string, realtime bool, frames chan<- capturedFrame) error {
+	defer close(frames)
+
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var previous time.Time
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 8192), 64*1024)
+
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		timeField, rest, ok := strings.Cut(line, " ")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected receive time and frame", name, lineNo)
+		}
+		hexField, label, _ := strings.Cut(strings.TrimSpace(rest), " ")
+		received, err := time.Parse(time.RFC3339Nano, timeField)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", name, lineNo, err)
+		}
+		data, err := hex.DecodeString(hexField)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", name, lineNo, err)
+		}
+
+		if realtime && !previous.IsZero() && received.After(previous) {
+			time.Sleep(received.Sub(previous))
+		}
+		previous = received
+
+		frames <- capturedFrame{rawFrame{data, received}, strings.TrimSpace(label)}
+	}
+
+	return scanner.Err()
+}
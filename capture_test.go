@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordSink records the label and meter ID of the readings written to it
+type recordSink struct {
+	mu       sync.Mutex
+	readings []string
+}
+
+func (s *recordSink) name() string {
+	return "record"
+}
+
+func (s *recordSink) write(reading *meterReading, timestamp time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.readings = append(s.readings, reading.label+"/"+reading.MeterID)
+	return nil
+}
+
+// writeCapture writes a capture file with the frames of testdata, in hex
+func writeCapture(t *testing.T, lines ...string) string {
+	t.Helper()
+
+	name := filepath.Join(t.TempDir(), "capture.txt")
+	if err := os.WriteFile(name, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return name
+}
+
+func captureLine(t *testing.T, frame string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("ams", "testdata", frame+".hex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return "2022-10-17T10:00:00+02:00 " + strings.TrimSpace(string(data))
+}
+
+func TestReplayWritesEveryReading(t *testing.T) {
+	const frames = 4 * sinkBufferSize
+
+	lines := make([]string, frames)
+	for i := range lines {
+		lines[i] = captureLine(t, "kamstrup_list2")
+	}
+	cfg := defaultConfig()
+	cfg.Replay = writeCapture(t, lines...)
+
+	fast, slow := &slowSink{}, &slowSink{delay: time.Millisecond}
+	if err := replay(&cfg, newFanOut([]Sink{fast, slow}), nil); err != nil {
+		t.Fatalf("replay() error = %v", err)
+	}
+
+	if n := fast.written.Load(); n != frames {
+		t.Errorf("fast sink got %d readings, want %d", n, frames)
+	}
+	if n := slow.written.Load(); n != frames {
+		t.Errorf("slow sink got %d readings, want %d", n, frames)
+	}
+}
+
+func TestReplayError(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Replay = writeCapture(t, captureLine(t, "kamstrup_list2"), "2022-10-17T10:00:02+02:00 7ea0zz")
+
+	sink := &slowSink{}
+	err := replay(&cfg, newFanOut([]Sink{sink}), nil)
+	if err == nil || !strings.Contains(err.Error(), "capture.txt:2") {
+		t.Errorf("replay() error = %v, want error on line 2", err)
+	}
+	if n := sink.written.Load(); n != 1 {
+		t.Errorf("sink got %d readings, want the 1 before the error", n)
+	}
+
+	cfg.Replay = filepath.Join(t.TempDir(), "missing.txt")
+	if err := replay(&cfg, newFanOut(nil), nil); err == nil {
+		t.Error("replay() of missing file succeeded")
+	}
+}
+
+func TestCaptureWrite(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "capture.txt")
+	capture, err := openCapture(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := time.Date(2022, 10, 17, 10, 0, 0, 500, time.UTC)
+	frame := testFrame(t, "kamstrup_list2")
+	for _, label := range []string{"", "heat pump"} {
+		if err := capture.write(label, rawFrame{frame, received}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	capture.close()
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "2022-10-17T10:00:00.0000005Z " + hex.EncodeToString(frame) + "\n" +
+		"2022-10-17T10:00:00.0000005Z " + hex.EncodeToString(frame) + " heat pump\n"
+	if string(data) != want {
+		t.Errorf("capture file =\n%s\nwant\n%s", data, want)
+	}
+}
+
+func TestReplayMeters(t *testing.T) {
+	// The encrypted frame can only be decoded with the keys of its meter
+	cfg := defaultConfig()
+	cfg.Label = "main"
+	cfg.Meters = []meterConfig{
+		{Label: "house", Device: "/dev/ttyUSB0"},
+		{
+			Label: "heat pump", Device: "/dev/ttyUSB1",
+			EncryptionKey:     "000102030405060708090a0b0c0d0e0f",
+			AuthenticationKey: "d0d1d2d3d4d5d6d7d8d9dadbdcdddedf",
+		},
+	}
+	cfg.Replay = writeCapture(t,
+		captureLine(t, "aidon_list3")+" house",
+		captureLine(t, "kamstrup_gcm")+" heat pump",
+		captureLine(t, "kamstrup_list2"),
+		captureLine(t, "kamstrup_list3")+" garage",
+		captureLine(t, "kamstrup_gcm")+" house",
+	)
+
+	sink := &recordSink{}
+	if err := replay(&cfg, newFanOut([]Sink{sink}), nil); err != nil {
+		t.Fatalf("replay() error = %v", err)
+	}
+
+	// Frames without label get the top level label, frames of meters that
+	// are not configured keep theirs
+	want := []string{"garage/5706567000000000", "heat pump/5706567000000000", "house/7359992890941742", "main/5706567000000000"}
+	sort.Strings(sink.readings)
+	if strings.Join(sink.readings, ",") != strings.Join(want, ",") {
+		t.Errorf("readings = %v, want %v", sink.readings, want)
+	}
+}
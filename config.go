@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tarm/serial"
+	"gopkg.in/yaml.v3"
+)
+
+// config is the configuration of the logger. It is read from the config
+// file, then overridden by environment variables and command line flags.
+// Fields tagged secret are redacted by -print-config.
+type config struct {
+	Label             string        `yaml:"label"`
+	Device            string        `yaml:"device"`
+	Serial            serialOptions `yaml:"serial"`
+	EncryptionKey     string        `yaml:"encryption_key" secret:"true"`
+	AuthenticationKey string        `yaml:"authentication_key" secret:"true"`
+	Timezone          string        `yaml:"timezone"`
+	OBISConfig        string        `yaml:"obis_config"`
+	Log               string        `yaml:"log"`
+	LogLevel          string        `yaml:"log_level"`
+	LogFormat         string        `yaml:"log_format"`
+	LogMaxSize        int64         `yaml:"log_max_size"`
+	LogMaxBackups     int           `yaml:"log_max_backups"`
+	Capture           string        `yaml:"capture"`
+	Replay            string        `yaml:"replay"`
+	ReplayRealtime    bool          `yaml:"replay_realtime"`
+
+	// Meters replaces the single meter given by label, device, serial and
+	// the keys above
+	Meters []meterConfig `yaml:"meters"`
+
+	InfluxDB influxConfig  `yaml:"influxdb"`
+	MQTT     mqttConfig    `yaml:"mqtt"`
+	Metrics  metricsConfig `yaml:"metrics"`
+	Archive  archiveConfig `yaml:"archive"`
+}
+
+// meterConfig is a meter read by the logger. Serial settings left out or
+// zero and empty keys default to the top level settings. A baud rate of auto
+// detects the serial port settings of the meter.
+type meterConfig struct {
+	Label             string         `yaml:"label"`
+	Device            string         `yaml:"device"`
+	Serial            *serialOptions `yaml:"serial,omitempty"`
+	EncryptionKey     string         `yaml:"encryption_key,omitempty" secret:"true"`
+	AuthenticationKey string         `yaml:"authentication_key,omitempty" secret:"true"`
+}
+
+type serialOptions struct {
+	Baud        baudRate      `yaml:"baud"`
+	DataBits    int           `yaml:"data_bits"`
+	Parity      string        `yaml:"parity"`
+	StopBits    string        `yaml:"stop_bits"`
+	ReadTimeout time.Duration `yaml:"read_timeout"`
+}
+
+type influxConfig struct {
+	URL          string `yaml:"url"`
+	Version      int    `yaml:"version"`
+	Precision    string `yaml:"precision"`
+	Database     string `yaml:"database"`
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password" secret:"true"`
+	Org          string `yaml:"org"`
+	Bucket       string `yaml:"bucket"`
+	Token        string `yaml:"token" secret:"true"`
+	Queue        string `yaml:"queue"`
+	QueueMaxSize int64  `yaml:"queue_max_size"`
+}
+
+type mqttConfig struct {
+	Broker    string `yaml:"broker"`
+	ClientID  string `yaml:"client_id"`
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password" secret:"true"`
+	CA        string `yaml:"ca"`
+	Insecure  bool   `yaml:"insecure"`
+	Topic     string `yaml:"topic"`
+	Retain    bool   `yaml:"retain"`
+	Discovery string `yaml:"discovery"`
+}
+
+type metricsConfig struct {
+	Listen string `yaml:"listen"`
+}
+
+type archiveConfig struct {
+	Dir     string `yaml:"dir"`
+	Format  string `yaml:"format"`
+	MaxSize int64  `yaml:"max_size"`
+	Gzip    bool   `yaml:"gzip"`
+}
+
+// envPrefix is the prefix of environment variables overriding the config,
+// followed by the upper case path of the setting, e.g. AMS_INFLUXDB_TOKEN
+const envPrefix = "AMS_"
+
+func defaultConfig() config {
+	return config{
+		Device: "/dev/ttyUSB0",
+		Serial: serialOptions{
+			Baud:        2400,
+			DataBits:    8,
+			Parity:      "none",
+			StopBits:    "1",
+			ReadTimeout: 400 * time.Millisecond,
+		},
+		Timezone:      "Local",
+		LogLevel:      "info",
+		LogFormat:     "text",
+		LogMaxSize:    10,
+		LogMaxBackups: 3,
+		InfluxDB: influxConfig{
+			URL:          "http://localhost:8086",
+			Version:      1,
+			Precision:    "s",
+			Database:     "meter",
+			QueueMaxSize: 100,
+		},
+		MQTT: mqttConfig{
+			ClientID:  "kamstrup_ams_logger",
+			Topic:     "ams",
+			Retain:    true,
+			Discovery: "homeassistant",
+		},
+		Archive: archiveConfig{
+			Format: "csv",
+		},
+	}
+}
+
+// registerFlags defines the command line flags, which write to c
+func registerFlags(fs *flag.FlagSet, c *config) {
+	fs.StringVar(&c.Label, "label", c.Label, "Label of the meter, written to all outputs")
+	fs.StringVar(&c.Device, "device", c.Device, "serial device name, or tcp://host:port or rfc2217://host:port for a network bridge")
+	fs.StringVar(&c.InfluxDB.URL, "url", c.InfluxDB.URL, "InfluxDB URL, empty to disable InfluxDB")
+	fs.StringVar(&c.InfluxDB.Database, "dbname", c.InfluxDB.Database, "InfluxDB database name")
+	fs.StringVar(&c.Log, "log", c.Log, "Log file, rotated when it reaches -log-max-size")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "Log level (debug, info, warn or error), debug logs every frame")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "Log format (text or json)")
+	fs.Int64Var(&c.LogMaxSize, "log-max-size", c.LogMaxSize, "Size in MB at which the log file is rotated, 0 to never rotate")
+	fs.IntVar(&c.LogMaxBackups, "log-max-backups", c.LogMaxBackups, "Number of rotated log files to keep")
+	fs.StringVar(&c.InfluxDB.Precision, "precision", c.InfluxDB.Precision, "InfluxDB timestamp precision (ns, us, ms or s)")
+	fs.IntVar(&c.InfluxDB.Version, "influx-version", c.InfluxDB.Version, "InfluxDB major version (1, 2 or 3)")
+	fs.StringVar(&c.InfluxDB.Org, "org", c.InfluxDB.Org, "InfluxDB 2.x organisation")
+	fs.StringVar(&c.InfluxDB.Bucket, "bucket", c.InfluxDB.Bucket, "InfluxDB 2.x/3.x bucket, defaults to the database name")
+	fs.StringVar(&c.InfluxDB.Token, "token", c.InfluxDB.Token, "InfluxDB 2.x/3.x API token")
+	fs.StringVar(&c.InfluxDB.Username, "username", c.InfluxDB.Username, "InfluxDB 1.x username")
+	fs.StringVar(&c.InfluxDB.Password, "password", c.InfluxDB.Password, "InfluxDB 1.x password")
+	fs.StringVar(&c.InfluxDB.Queue, "queue", c.InfluxDB.Queue, "Directory to queue points in while InfluxDB is unreachable")
+	fs.Int64Var(&c.InfluxDB.QueueMaxSize, "queue-max-size", c.InfluxDB.QueueMaxSize, "Maximum size of the queue in MB")
+	fs.StringVar(&c.MQTT.Broker, "mqtt-broker", c.MQTT.Broker, "MQTT broker URL, e.g. tcp://localhost:1883 or ssl://localhost:8883")
+	fs.StringVar(&c.MQTT.ClientID, "mqtt-client-id", c.MQTT.ClientID, "MQTT client ID")
+	fs.StringVar(&c.MQTT.Username, "mqtt-username", c.MQTT.Username, "MQTT username")
+	fs.StringVar(&c.MQTT.Password, "mqtt-password", c.MQTT.Password, "MQTT password")
+	fs.StringVar(&c.MQTT.CA, "mqtt-ca", c.MQTT.CA, "CA certificate file for MQTT over TLS")
+	fs.BoolVar(&c.MQTT.Insecure, "mqtt-insecure", c.MQTT.Insecure, "Skip verification of the MQTT broker certificate")
+	fs.StringVar(&c.MQTT.Topic, "mqtt-topic", c.MQTT.Topic, "MQTT topic prefix")
+	fs.BoolVar(&c.MQTT.Retain, "mqtt-retain", c.MQTT.Retain, "Publish MQTT state messages retained")
+	fs.StringVar(&c.MQTT.Discovery, "mqtt-discovery", c.MQTT.Discovery, "Home Assistant discovery prefix, empty to disable discovery")
+	fs.StringVar(&c.Metrics.Listen, "metrics-listen", c.Metrics.Listen, "Address to serve Prometheus metrics on, e.g. :9162")
+	fs.StringVar(&c.Archive.Dir, "archive", c.Archive.Dir, "Directory to archive every reading in")
+	fs.StringVar(&c.Archive.Format, "archive-format", c.Archive.Format, "Archive file format (csv or json)")
+	fs.Int64Var(&c.Archive.MaxSize, "archive-max-size", c.Archive.MaxSize, "Size in MB at which a new archive file is started, 0 for one file per day")
+	fs.BoolVar(&c.Archive.Gzip, "archive-gzip", c.Archive.Gzip, "Compress closed archive files")
+	fs.StringVar(&c.Capture, "capture", c.Capture, "File to store every received frame in")
+	fs.StringVar(&c.Replay, "replay", c.Replay, "Capture file to decode instead of reading the serial device")
+	fs.BoolVar(&c.ReplayRealtime, "replay-realtime", c.ReplayRealtime, "Replay frames with the delays they were received with")
+	fs.Var(&c.Serial.Baud, "baud", "Serial port baud rate, auto or 0 to detect the serial port settings")
+	fs.IntVar(&c.Serial.DataBits, "data-bits", c.Serial.DataBits, "Serial port data bits")
+	fs.StringVar(&c.Serial.Parity, "parity", c.Serial.Parity, "Serial port parity (none, odd, even, mark or space)")
+	fs.StringVar(&c.Serial.StopBits, "stop-bits", c.Serial.StopBits, "Serial port stop bits (1, 1.5 or 2)")
+	fs.DurationVar(&c.Serial.ReadTimeout, "read-timeout", c.Serial.ReadTimeout, "Serial port read timeout")
+	fs.StringVar(&c.EncryptionKey, "encryption-key", c.EncryptionKey, "Encryption key (GUEK) of meters with encrypted HAN port, 32 hex digits")
+	fs.StringVar(&c.AuthenticationKey, "authentication-key", c.AuthenticationKey, "Authentication key (GAK) of meters with encrypted HAN port, 32 hex digits")
+	fs.StringVar(&c.OBISConfig, "obis-config", c.OBISConfig, "OBIS mapping file, see obis.yaml for the default")
+	fs.StringVar(&c.Timezone, "timezone", c.Timezone, "Time zone of the meter clock, used when the meter does not send its deviation from UTC")
+}
+
+// loadConfig builds the configuration from the defaults, the config file
+// given with -config, the environment and the command line flags, in
+// increasing priority. printConfig is set by the -print-config flag.
+func loadConfig(args []string) (c config, printConfig bool, err error) {
+	// The flags are parsed twice: first to find the config file, then over
+	// the loaded config so that only flags given override it
+	var configFile string
+	fs := newFlagSet(&config{}, &configFile, &printConfig)
+	if err := fs.Parse(args); err != nil {
+		return c, false, err
+	}
+
+	c = defaultConfig()
+	if configFile != "" {
+		if err := c.readFile(configFile); err != nil {
+			return c, false, fmt.Errorf("%s: %v", configFile, err)
+		}
+	}
+	if err := c.applyEnv(os.Environ()); err != nil {
+		return c, false, err
+	}
+
+	fs = newFlagSet(&c, &configFile, &printConfig)
+	if err := fs.Parse(args); err != nil {
+		return c, false, err
+	}
+
+	return c, printConfig, nil
+}
+
+func newFlagSet(c *config, configFile *string, printConfig *bool) *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.StringVar(configFile, "config", "", "Config file, see -print-config for its format")
+	fs.BoolVar(printConfig, "print-config", false, "Print the effective configuration with secrets redacted and exit")
+	registerFlags(fs, c)
+
+	return fs
+}
+
+// readFile reads the YAML config file. Unknown settings are an error, so
+// that typos are not silently ignored.
+func (c *config) readFile(name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && err != io.EOF {
+		return err
+	}
+
+	return nil
+}
+
+// applyEnv overrides settings from environment variables named after the
+// setting path, e.g. AMS_DEVICE or AMS_MQTT_PASSWORD
+func (c *config) applyEnv(environ []string) error {
+	values := make(map[string]string)
+	for _, kv := range environ {
+		if name, value, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(name, envPrefix) {
+			values[name] = value
+		}
+	}
+
+	return forEachSetting(reflect.ValueOf(c).Elem(), "", func(path string, v reflect.Value, _ bool) error {
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+		s, ok := values[name]
+		if !ok {
+			return nil
+		}
+		if err := setValue(v, s); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		return nil
+	})
+}
+
+// forEachSetting calls fn for every setting in the config struct v, with its
+// path such as influxdb.token and whether it is secret
+func forEachSetting(v reflect.Value, prefix string, fn func(path string, v reflect.Value, secret bool) error) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		path := prefix + f.Tag.Get("yaml")
+
+		path = strings.TrimSuffix(path, ",omitempty")
+		field := v.Field(i)
+
+		var err error
+		switch {
+		case f.Type.Kind() == reflect.Struct:
+			err = forEachSetting(field, path+".", fn)
+		case f.Type.Kind() == reflect.Pointer:
+			if !field.IsNil() {
+				err = forEachSetting(field.Elem(), path+".", fn)
+			}
+		case f.Type.Kind() == reflect.Slice:
+			for j := 0; j < field.Len() && err == nil; j++ {
+				err = forEachSetting(field.Index(j), fmt.Sprintf("%s.%d.", path, j), fn)
+			}
+		default:
+			err = fn(path, field, f.Tag.Get("secret") == "true")
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setValue sets a setting from its text form
+func setValue(v reflect.Value, s string) error {
+	if f, ok := v.Addr().Interface().(flag.Value); ok {
+		return f.Set(s)
+	}
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+
+	return nil
+}
+
+// validate checks the configuration and returns all problems found
+func (c *config) validate() error {
+	var problems []string
+	check := func(ok bool, setting string, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, setting+": "+fmt.Sprintf(format, args...))
+		}
+	}
+
+	labels := make(map[string]bool)
+	devices := make(map[string]bool)
+	for i, m := range c.meters() {
+		prefix := ""
+		if len(c.Meters) > 0 {
+			prefix = fmt.Sprintf("meters.%d.", i)
+		}
+
+		if c.Replay == "" {
+			check(m.Device != "", prefix+"device", "no device given")
+			check(!devices[m.Device], prefix+"device", "%s is used by another meter", m.Device)
+			devices[m.Device] = true
+			serialConfig, err := m.serialConfig()
+			check(err == nil, prefix+"serial", "%v", err)
+			check(err != nil || serialConfig.Baud != 0 || !isNetworkDevice(m.Device), prefix+"serial.baud", "settings cannot be detected on network devices")
+		}
+		if len(c.Meters) > 1 {
+			check(m.Label != "", prefix+"label", "every meter needs a label")
+		}
+		check(m.Label == "" || !labels[m.Label], prefix+"label", "%q is used by another meter", m.Label)
+		labels[m.Label] = true
+
+		_, err := parseKey(m.EncryptionKey)
+		check(err == nil, prefix+"encryption_key", "%v", err)
+		_, err = parseKey(m.AuthenticationKey)
+		check(err == nil, prefix+"authentication_key", "%v", err)
+	}
+
+	_, ok := logLevels[strings.ToLower(c.LogLevel)]
+	check(ok, "log_level", "must be debug, info, warn or error")
+	check(c.LogFormat == "text" || c.LogFormat == "json", "log_format", "must be text or json")
+	check(c.LogMaxSize >= 0, "log_max_size", "must not be negative")
+	check(c.LogMaxBackups >= 0, "log_max_backups", "must not be negative")
+
+	_, err := time.LoadLocation(c.Timezone)
+	check(err == nil, "timezone", "%v", err)
+
+	if c.InfluxDB.URL != "" {
+		u, err := url.Parse(c.InfluxDB.URL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https"), "influxdb.url", "must be an http or https URL")
+		influx := c.newInfluxWriter()
+		err = influx.validate()
+		check(err == nil, "influxdb", "%v", err)
+		check(c.InfluxDB.QueueMaxSize > 0, "influxdb.queue_max_size", "must be positive")
+	}
+
+	if c.MQTT.Broker != "" {
+		u, err := url.Parse(c.MQTT.Broker)
+		check(err == nil && u.Host != "", "mqtt.broker", "must be a URL such as tcp://host:1883")
+		check(c.MQTT.Topic != "", "mqtt.topic", "must not be empty")
+	}
+
+	if c.Archive.Dir != "" {
+		check(c.Archive.Format == "csv" || c.Archive.Format == "json", "archive.format", "must be csv or json")
+		check(c.Archive.MaxSize >= 0, "archive.max_size", "must not be negative")
+	}
+
+	if c.Capture != "" && c.Replay != "" {
+		check(!samePath(c.Capture, c.Replay), "capture", "must not be the replay file")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
+
+// samePath reports whether a and b name the same file, as cleaned absolute
+// paths or, when both exist, through links
+func samePath(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA == nil && errB == nil && absA == absB {
+		return true
+	}
+
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	return errA == nil && errB == nil && os.SameFile(infoA, infoB)
+}
+
+// meters returns the meters to read, with the defaults from the top level
+// settings applied
+func (c *config) meters() []meterConfig {
+	if len(c.Meters) == 0 {
+		return []meterConfig{{
+			Label:             c.Label,
+			Device:            c.Device,
+			Serial:            &c.Serial,
+			EncryptionKey:     c.EncryptionKey,
+			AuthenticationKey: c.AuthenticationKey,
+		}}
+	}
+
+	meters := make([]meterConfig, len(c.Meters))
+	for i, m := range c.Meters {
+		m.Serial = c.Serial.merge(m.Serial)
+		if m.EncryptionKey == "" {
+			m.EncryptionKey = c.EncryptionKey
+		}
+		if m.AuthenticationKey == "" {
+			m.AuthenticationKey = c.AuthenticationKey
+		}
+		meters[i] = m
+	}
+
+	return meters
+}
+
+// merge returns the settings of o, with the settings it leaves zero taken
+// from s. A baud rate of auto is kept, so a meter can detect its settings
+// when the top level baud rate is given.
+func (s serialOptions) merge(o *serialOptions) *serialOptions {
+	if o == nil {
+		return &s
+	}
+
+	merged := *o
+	if merged.Baud == 0 {
+		merged.Baud = s.Baud
+	}
+	if merged.DataBits == 0 {
+		merged.DataBits = s.DataBits
+	}
+	if merged.Parity == "" {
+		merged.Parity = s.Parity
+	}
+	if merged.StopBits == "" {
+		merged.StopBits = s.StopBits
+	}
+	if merged.ReadTimeout == 0 {
+		merged.ReadTimeout = s.ReadTimeout
+	}
+
+	return &merged
+}
+
+// serialConfig returns the serial port settings of the meter. The baud rate
+// is 0 when the settings are detected.
+func (m *meterConfig) serialConfig() (*serial.Config, error) {
+	baud := int(m.Serial.Baud)
+	if m.Serial.Baud == baudAuto {
+		baud = 0
+	}
+
+	return newSerialConfig(baud, m.Serial.DataBits, m.Serial.Parity, m.Serial.StopBits, m.Serial.ReadTimeout)
+}
+
+// baudRate is a serial port baud rate, given as a number or auto. Both auto
+// and 0 detect the serial port settings, but in the settings of a meter 0
+// takes the top level baud rate.
+type baudRate int
+
+// baudAuto is the baud rate given as auto
+const baudAuto baudRate = -1
+
+func (b baudRate) String() string {
+	if b == baudAuto {
+		return "auto"
+	}
+
+	return strconv.Itoa(int(b))
+}
+
+// Set parses the baud rate, as a flag value and from the environment
+func (b *baudRate) Set(s string) error {
+	if s == "auto" {
+		*b = baudAuto
+		return nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid baud rate %q, must be a number or auto", s)
+	}
+	*b = baudRate(n)
+
+	return nil
+}
+
+func (b *baudRate) UnmarshalYAML(node *yaml.Node) error {
+	if err := b.Set(node.Value); err != nil {
+		return fmt.Errorf("line %d: %v", node.Line, err)
+	}
+
+	return nil
+}
+
+func (b baudRate) MarshalYAML() (interface{}, error) {
+	if b == baudAuto {
+		return "auto", nil
+	}
+
+	return int(b), nil
+}
+
+// newInfluxWriter returns the InfluxDB writer for the configuration
+func (c *config) newInfluxWriter() *influxWriter {
+	influx := newInfluxWriter(c.InfluxDB.URL, c.InfluxDB.Version, c.InfluxDB.Precision)
+	influx.database = c.InfluxDB.Database
+	influx.username = c.InfluxDB.Username
+	influx.password = c.InfluxDB.Password
+	influx.org = c.InfluxDB.Org
+	influx.bucket = c.InfluxDB.Bucket
+	if influx.bucket == "" {
+		influx.bucket = c.InfluxDB.Database
+	}
+	influx.token = c.InfluxDB.Token
+
+	return influx
+}
+
+// print writes the configuration as YAML with secrets redacted. Every meter
+// is printed with the settings it takes from the top level, so the settings
+// it is read with are shown.
+func (c config) print(w io.Writer) error {
+	// meters returns copies, which can be redacted without changing the
+	// original
+	if len(c.Meters) > 0 {
+		c.Meters = c.meters()
+	}
+
+	forEachSetting(reflect.ValueOf(&c).Elem(), "", func(_ string, v reflect.Value, secret bool) error {
+		if secret && v.String() != "" {
+			v.SetString("REDACTED")
+		}
+		return nil
+	})
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c); err != nil {
+		return err
+	}
+
+	return encoder.Close()
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestMeterBaudRate(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(name, []byte(`
+serial:
+  baud: 9600
+meters:
+  - label: house
+    device: /dev/ttyUSB0
+  - label: heat pump
+    device: /dev/ttyUSB1
+    serial:
+      baud: auto
+  - label: garage
+    device: /dev/ttyUSB2
+    serial:
+      baud: 0
+      parity: even
+  - label: shed
+    device: /dev/ttyUSB3
+    serial:
+      baud: 115200
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, _, err := loadConfig([]string{"-config", name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 0 takes the top level baud rate, auto detects the settings
+	want := []int{9600, 0, 9600, 115200}
+	for i, m := range cfg.meters() {
+		serialConfig, err := m.serialConfig()
+		if err != nil {
+			t.Fatalf("%s: serialConfig() error = %v", m.Label, err)
+		}
+		if serialConfig.Baud != want[i] {
+			t.Errorf("%s: baud %d, want %d", m.Label, serialConfig.Baud, want[i])
+		}
+	}
+}
+
+func TestBaudRate(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		env     []string
+		want    baudRate
+		wantErr bool
+	}{
+		{"default", nil, nil, 2400, false},
+		{"flag", []string{"-baud", "115200"}, nil, 115200, false},
+		{"flag 0", []string{"-baud", "0"}, nil, 0, false},
+		{"flag auto", []string{"-baud", "auto"}, nil, baudAuto, false},
+		{"environment auto", nil, []string{"AMS_SERIAL_BAUD=auto"}, baudAuto, false},
+		{"environment", nil, []string{"AMS_SERIAL_BAUD=9600"}, 9600, false},
+		{"environment invalid", nil, []string{"AMS_SERIAL_BAUD=fast"}, 0, true},
+		{"environment negative", nil, []string{"AMS_SERIAL_BAUD=-1"}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			err := cfg.applyEnv(tt.env)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyEnv() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			fs := newFlagSet(&cfg, new(string), new(bool))
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Serial.Baud != tt.want {
+				t.Errorf("baud = %v, want %v", cfg.Serial.Baud, tt.want)
+			}
+
+			m := cfg.meters()[0]
+			serialConfig, err := m.serialConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == baudAuto && serialConfig.Baud != 0 {
+				t.Errorf("serial baud = %d, want 0 to detect", serialConfig.Baud)
+			}
+		})
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	tests := map[string]bool{
+		"400ms": true,
+		"25.5s": true,
+		"25.6s": false,
+		"1m":    false,
+		"0s":    false,
+		"-1s":   false,
+	}
+
+	for timeout, ok := range tests {
+		cfg, _, err := loadConfig([]string{"-read-timeout", timeout})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = cfg.validate()
+		if (err == nil) != ok {
+			t.Errorf("read timeout %s: validate() error = %v, want ok %v", timeout, err, ok)
+		}
+		if err != nil && !strings.Contains(err.Error(), "read timeout") {
+			t.Errorf("read timeout %s: validate() error = %v", timeout, err)
+		}
+	}
+}
+
+// writeConfig writes a config file and returns its name
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	name := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return name
+}
+
+func TestApplyEnv(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Meters = []meterConfig{{Label: "house"}, {Label: "heat pump", Serial: &serialOptions{}}}
+
+	err := cfg.applyEnv([]string{
+		"AMS_DEVICE=/dev/ttyAMA0",
+		"AMS_INFLUXDB_TOKEN=abc=",
+		"AMS_INFLUXDB_QUEUE_MAX_SIZE=5",
+		"AMS_MQTT_RETAIN=false",
+		"AMS_SERIAL_READ_TIMEOUT=2s",
+		"AMS_METERS_1_DEVICE=/dev/ttyUSB1",
+		"AMS_METERS_1_SERIAL_PARITY=even",
+		"AMS_UNKNOWN=1",
+		"DEVICE=/dev/null",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Device != "/dev/ttyAMA0" || cfg.InfluxDB.Token != "abc=" || cfg.InfluxDB.QueueMaxSize != 5 ||
+		cfg.MQTT.Retain || cfg.Serial.ReadTimeout != 2*time.Second {
+		t.Errorf("config = %+v", cfg)
+	}
+	if cfg.Meters[1].Device != "/dev/ttyUSB1" || cfg.Meters[1].Serial.Parity != "even" || cfg.Meters[0].Device != "" {
+		t.Errorf("meters = %+v, %+v", cfg.Meters[1], *cfg.Meters[1].Serial)
+	}
+
+	// Errors name the variable
+	for _, env := range []string{"AMS_LOG_MAX_SIZE=big", "AMS_MQTT_INSECURE=maybe", "AMS_SERIAL_READ_TIMEOUT=1"} {
+		cfg := defaultConfig()
+		name, _, _ := strings.Cut(env, "=")
+		if err := cfg.applyEnv([]string{env}); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("applyEnv(%s) error = %v", env, err)
+		}
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	name := writeConfig(t, `
+device: /dev/file
+label: file
+influxdb:
+  url: http://file:8086
+  database: file
+  token: file
+`)
+	t.Setenv("AMS_DEVICE", "/dev/env")
+	t.Setenv("AMS_INFLUXDB_DATABASE", "env")
+
+	cfg, printConfig, err := loadConfig([]string{"-config", name, "-device", "/dev/flag", "-print-config"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flags over the environment over the file over the defaults
+	if cfg.Device != "/dev/flag" || cfg.InfluxDB.Database != "env" || cfg.Label != "file" ||
+		cfg.InfluxDB.URL != "http://file:8086" || cfg.InfluxDB.Precision != "s" || !printConfig {
+		t.Errorf("config = %+v, print %v", cfg, printConfig)
+	}
+
+	if _, _, err := loadConfig([]string{"-config", writeConfig(t, "devise: /dev/ttyUSB0\n")}); err == nil {
+		t.Error("loadConfig() accepted an unknown setting")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		args   []string
+		want   []string // settings with problems
+	}{
+		{"defaults", "", nil, nil},
+		{
+			"top level", "", []string{"-log-level", "loud", "-log-format", "xml", "-timezone", "Mars/Olympus", "-precision", "m", "-encryption-key", "0102"},
+			[]string{"log_level", "log_format", "timezone", "influxdb", "encryption_key"},
+		},
+		{"outputs", "", []string{"-url", "ftp://x", "-mqtt-broker", "localhost", "-archive", "/tmp", "-archive-format", "xml"}, []string{"influxdb.url", "mqtt.broker", "archive.format"}},
+		{
+			"meters", `
+meters:
+  - label: house
+    device: /dev/ttyUSB0
+  - label: house
+    device: /dev/ttyUSB0
+    serial:
+      parity: odd-ish
+  - device: tcp://bridge:2000
+    serial:
+      baud: auto
+`,
+			nil, []string{"meters.1.label", "meters.1.device", "meters.1.serial", "meters.2.label", "meters.2.serial.baud"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.config != "" {
+				args = append([]string{"-config", writeConfig(t, tt.config)}, args...)
+			}
+			cfg, _, err := loadConfig(args)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = cfg.validate()
+			if (err != nil) != (len(tt.want) > 0) {
+				t.Fatalf("validate() error = %v", err)
+			}
+			for _, setting := range tt.want {
+				if !strings.Contains(err.Error(), "\n  "+setting+": ") {
+					t.Errorf("validate() error = %v, want a problem with %s", err, setting)
+				}
+			}
+		})
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	cfg, _, err := loadConfig([]string{"-config", writeConfig(t, `
+encryption_key: 000102030405060708090a0b0c0d0e0f
+serial:
+  baud: 9600
+  parity: even
+influxdb:
+  token: secret-token
+meters:
+  - label: house
+    device: /dev/ttyUSB0
+  - label: heat pump
+    device: /dev/ttyUSB1
+    authentication_key: d0d1d2d3d4d5d6d7d8d9dadbdcdddedf
+    serial:
+      baud: auto
+`), "-mqtt-password", "secret-password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := cfg.print(&out); err != nil {
+		t.Fatal(err)
+	}
+	printed := out.String()
+
+	for _, secret := range []string{"000102", "d0d1d2", "secret-token", "secret-password"} {
+		if strings.Contains(printed, secret) {
+			t.Errorf("printed config contains %s:\n%s", secret, printed)
+		}
+	}
+	if cfg.InfluxDB.Token != "secret-token" || cfg.Meters[1].AuthenticationKey == "REDACTED" {
+		t.Error("print() redacted the configuration")
+	}
+
+	// The printed meters carry the settings they are read with
+	var printedCfg config
+	if err := yaml.Unmarshal([]byte(printed), &printedCfg); err != nil {
+		t.Fatal(err)
+	}
+	meters := printedCfg.Meters
+	if len(meters) != 2 || meters[0].Serial == nil || meters[1].Serial == nil {
+		t.Fatalf("printed meters = %+v", meters)
+	}
+	if s := meters[0].Serial; s.Baud != 9600 || s.Parity != "even" || s.DataBits != 8 || s.ReadTimeout != 400*time.Millisecond {
+		t.Errorf("house serial = %+v", *s)
+	}
+	if s := meters[1].Serial; s.Baud != baudAuto || s.Parity != "even" {
+		t.Errorf("heat pump serial = %+v", *s)
+	}
+	if meters[0].EncryptionKey != "REDACTED" || meters[0].AuthenticationKey != "" || meters[1].AuthenticationKey != "REDACTED" {
+		t.Errorf("printed keys = %+v", meters)
+	}
+}
+
+func TestCaptureReplaySameFile(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	os.WriteFile("capture.txt", nil, 0644)
+	os.Symlink("capture.txt", "link.txt")
+
+	tests := []struct {
+		capture, replay string
+		ok              bool
+	}{
+		{"capture.txt", "capture.txt", false},
+		{"./capture.txt", filepath.Join(dir, "capture.txt"), false},
+		{"sub/../capture.txt", "capture.txt", false},
+		{"link.txt", "capture.txt", false},
+		{"new.txt", "capture.txt", true},
+		{"capture.txt", "", true},
+	}
+
+	for _, tt := range tests {
+		cfg, _, err := loadConfig([]string{"-capture", tt.capture, "-replay", tt.replay})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.validate(); (err == nil) != tt.ok {
+			t.Errorf("capture %s, replay %s: validate() error = %v", tt.capture, tt.replay, err)
+		}
+	}
+}
@@ -1,30 +1,198 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
-func writeToDatabase() {
-	str := fmt.Sprintf("data,meter=%s active_power_plus=%d\n", meter.meterID, meter.activePowerPlus)
-	str += fmt.Sprintf("data,meter=%s active_power_minus=%d\n", meter.meterID, meter.activePowerMinus)
-	str += fmt.Sprintf("data,meter=%s reactive_power_plus=%d\n", meter.meterID, meter.reactivePowerPlus)
-	str += fmt.Sprintf("data,meter=%s reactive_power_minus=%d\n", meter.meterID, meter.reactivePowerMinus)
-	str += fmt.Sprintf("data,meter=%s l1_current=%f\n", meter.meterID, meter.l1Current)
-	str += fmt.Sprintf("data,meter=%s l2_current=%f\n", meter.meterID, meter.l2Current)
-	str += fmt.Sprintf("data,meter=%s l3_current=%f\n", meter.meterID, meter.l3Current)
-	str += fmt.Sprintf("data,meter=%s l1_voltage=%d\n", meter.meterID, meter.l1Voltage)
-	str += fmt.Sprintf("data,meter=%s l2_voltage=%d\n", meter.meterID, meter.l2Voltage)
-	str += fmt.Sprintf("data,meter=%s l3_voltage=%d\n", meter.meterID, meter.l3Voltage)
-
-	r := strings.NewReader(str)
-
-	resp, err := http.Post(*influxURL+"/write?db="+*dbname, "application/x-www-form-urlencoded", r)
+// precisions maps the InfluxDB timestamp precision to its duration
+var precisions = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// tagEscaper escapes the characters with special meaning in line protocol
+// tag values
+var tagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// influxWriter writes readings to InfluxDB. Version 1 uses the /write
+// endpoint with optional basic authentication, version 2 and 3 use the
+// /api/v2/write endpoint with token authentication.
+type influxWriter struct {
+	url       string
+	version   int
+	precision string
+
+	// Version 1
+	database string
+	username string
+	password string
+
+	// Version 2 and 3. InfluxDB 3 ignores the organisation.
+	org    string
+	bucket string
+	token  string
+
+	client *http.Client
+}
+
+func newInfluxWriter(url string, version int, precision string) *influxWriter {
+	return &influxWriter{
+		url:       strings.TrimSuffix(url, "/"),
+		version:   version,
+		precision: precision,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// validate checks that the settings needed for the version are present
+func (w *influxWriter) validate() error {
+	if _, ok := precisions[w.precision]; !ok {
+		return fmt.Errorf("invalid timestamp precision: %s", w.precision)
+	}
+
+	switch w.version {
+	case 1:
+		if w.database == "" {
+			return fmt.Errorf("InfluxDB 1.x needs a database name")
+		}
+	case 2:
+		if w.org == "" {
+			return fmt.Errorf("InfluxDB 2.x needs an organisation")
+		}
+		fallthrough
+	case 3:
+		if w.bucket == "" {
+			return fmt.Errorf("InfluxDB %d.x needs a bucket", w.version)
+		}
+	default:
+		return fmt.Errorf("unsupported InfluxDB version: %d", w.version)
+	}
+
+	return nil
+}
+
+func (w *influxWriter) writeURL(precision string) string {
+	if w.version == 1 {
+		// InfluxDB 1.x calls microseconds u
+		if precision == "us" {
+			precision = "u"
+		}
+		query := url.Values{"db": {w.database}, "precision": {precision}}
+		return w.url + "/write?" + query.Encode()
+	}
+
+	query := url.Values{"bucket": {w.bucket}, "precision": {precision}}
+	if w.org != "" {
+		query.Set("org", w.org)
+	}
+	return w.url + "/api/v2/write?" + query.Encode()
+}
+
+func (w *influxWriter) name() string {
+	return "InfluxDB"
+}
+
+func (w *influxWriter) write(reading *meterReading, timestamp time.Time) error {
+	line := lineProtocol(reading, timestamp, precisions[w.precision])
+	if line == "" {
+		return nil
+	}
+
+	return w.writeLines(line, w.precision)
+}
+
+// errRejected is returned by writeLines when InfluxDB rejects the points
+// themselves, sending them again will not help.
+var errRejected = errors.New("points rejected")
+
+// writeLines sends points in line protocol with timestamps in precision
+func (w *influxWriter) writeLines(body string, precision string) error {
+	req, err := http.NewRequest(http.MethodPost, w.writeURL(precision), strings.NewReader(body))
 	if err != nil {
-		log.Println(err.Error())
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	if w.version == 1 && w.username != "" {
+		req.SetBasicAuth(w.username, w.password)
+	} else if w.version > 1 && w.token != "" {
+		req.Header.Set("Authorization", "Token "+w.token)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("InfluxDB write failed: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusRequestEntityTooLarge {
+			err = fmt.Errorf("%w: %v", errRejected, err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// lineProtocol formats the reading as a single point with all fields. It
+// returns an empty string if no field is written to InfluxDB.
+func lineProtocol(reading *meterReading, timestamp time.Time, precision time.Duration) string {
+	fields := readingFields(reading, "influxdb")
+	if len(fields) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+
+	b.WriteString("data,meter=")
+	b.WriteString(tagEscaper.Replace(reading.MeterID))
+	if reading.label != "" {
+		b.WriteString(",label=")
+		b.WriteString(tagEscaper.Replace(reading.label))
+	}
+
+	for i, f := range fields {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(tagEscaper.Replace(f.name))
+		b.WriteByte('=')
+		b.WriteString(formatField(f))
+	}
+
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatInt(timestamp.UnixNano()/int64(precision), 10))
+	b.WriteByte('\n')
+
+	return b.String()
+}
+
+// stringEscaper escapes string field values in the line protocol
+var stringEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+
+// formatField formats the value for the line protocol. The unit is not
+// written, values are always in the unit of the mapping.
+func formatField(f field) string {
+	switch f.kind {
+	case "string":
+		return `"` + stringEscaper.Replace(f.text) + `"`
+	case "integer":
+		return f.format() + "i"
 	}
 
-	_ = resp.Close
+	return f.format()
 }
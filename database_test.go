@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// influxRequest is a write request received by the InfluxDB stand-in
+type influxRequest struct {
+	path          string
+	query         url.Values
+	authorization string
+	contentType   string
+	body          string
+}
+
+// newInfluxServer starts an InfluxDB stand-in answering every write with
+// status and message, and sending the requests on the returned channel
+func newInfluxServer(t *testing.T, status int, message string) (*httptest.Server, chan influxRequest) {
+	requests := make(chan influxRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- influxRequest{r.URL.Path, r.URL.Query(), r.Header.Get("Authorization"), r.Header.Get("Content-Type"), string(body)}
+		w.WriteHeader(status)
+		io.WriteString(w, message)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, requests
+}
+
+func TestInfluxWriterRequests(t *testing.T) {
+	tests := []struct {
+		name          string
+		setup         func(w *influxWriter)
+		path          string
+		query         url.Values
+		authorization string
+	}{
+		{
+			"v1", func(w *influxWriter) { w.version, w.database = 1, "meter" },
+			"/write", url.Values{"db": {"meter"}, "precision": {"s"}}, "",
+		},
+		{
+			"v1 basic auth", func(w *influxWriter) { w.version, w.database, w.username, w.password = 1, "meter", "ams", "secret" },
+			"/write", url.Values{"db": {"meter"}, "precision": {"s"}}, "Basic YW1zOnNlY3JldA==",
+		},
+		{
+			"v1 microseconds", func(w *influxWriter) { w.version, w.database, w.precision = 1, "meter", "us" },
+			"/write", url.Values{"db": {"meter"}, "precision": {"u"}}, "",
+		},
+		{
+			"v2", func(w *influxWriter) { w.version, w.org, w.bucket, w.token = 2, "home", "meter", "abc" },
+			"/api/v2/write", url.Values{"org": {"home"}, "bucket": {"meter"}, "precision": {"s"}}, "Token abc",
+		},
+		{
+			"v2 milliseconds", func(w *influxWriter) { w.version, w.org, w.bucket, w.precision = 2, "home", "meter", "ms" },
+			"/api/v2/write", url.Values{"org": {"home"}, "bucket": {"meter"}, "precision": {"ms"}}, "",
+		},
+		{
+			"v3", func(w *influxWriter) { w.version, w.bucket, w.token = 3, "meter", "abc" },
+			"/api/v2/write", url.Values{"bucket": {"meter"}, "precision": {"s"}}, "Token abc",
+		},
+	}
+
+	reading := testReading(t, "kamstrup_list2", "")
+	timestamp := time.Date(2022, 10, 17, 10, 0, 0, 0, time.UTC)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := newInfluxServer(t, http.StatusNoContent, "")
+			w := newInfluxWriter(server.URL+"/", 1, "s")
+			tt.setup(w)
+			if err := w.validate(); err != nil {
+				t.Fatalf("validate() error = %v", err)
+			}
+
+			if err := w.write(reading, timestamp); err != nil {
+				t.Fatalf("write() error = %v", err)
+			}
+
+			r := <-requests
+			if r.path != tt.path {
+				t.Errorf("path = %s, want %s", r.path, tt.path)
+			}
+			if r.query.Encode() != tt.query.Encode() {
+				t.Errorf("query = %s, want %s", r.query.Encode(), tt.query.Encode())
+			}
+			if r.authorization != tt.authorization {
+				t.Errorf("Authorization = %q, want %q", r.authorization, tt.authorization)
+			}
+			if r.contentType != "text/plain; charset=utf-8" {
+				t.Errorf("Content-Type = %q", r.contentType)
+			}
+			if !strings.HasPrefix(r.body, "data,meter=5706567000000000 active_power_plus=1234,") {
+				t.Errorf("body = %q", r.body)
+			}
+		})
+	}
+}
+
+func TestInfluxWriterStatus(t *testing.T) {
+	tests := []struct {
+		status   int
+		wantErr  bool
+		rejected bool
+	}{
+		{http.StatusNoContent, false, false},
+		{http.StatusOK, true, false},
+		{http.StatusBadRequest, true, true},
+		{http.StatusUnauthorized, true, false},
+		{http.StatusNotFound, true, false},
+		{http.StatusRequestEntityTooLarge, true, true},
+		{http.StatusTooManyRequests, true, false},
+		{http.StatusInternalServerError, true, false},
+		{http.StatusServiceUnavailable, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			server, _ := newInfluxServer(t, tt.status, `{"message":"partial write"}`)
+			w := newInfluxWriter(server.URL, 1, "s")
+			w.database = "meter"
+
+			err := w.writeLines("data,meter=1 active_power_plus=1 1\n", "s")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("writeLines() error = %v, want error %v", err, tt.wantErr)
+			}
+			if errors.Is(err, errRejected) != tt.rejected {
+				t.Errorf("writeLines() error = %v, rejected %v", err, tt.rejected)
+			}
+			if err != nil && !strings.Contains(err.Error(), "partial write") {
+				t.Errorf("writeLines() error = %v, want the response message", err)
+			}
+		})
+	}
+}
+
+func TestInfluxWriterUnreachable(t *testing.T) {
+	server, _ := newInfluxServer(t, http.StatusNoContent, "")
+	server.Close()
+
+	w := newInfluxWriter(server.URL, 1, "s")
+	w.database = "meter"
+	err := w.writeLines("data,meter=1 active_power_plus=1 1\n", "s")
+	if err == nil || errors.Is(err, errRejected) {
+		t.Errorf("writeLines() error = %v, want a connection error", err)
+	}
+}
+
+func TestInfluxWriterValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(w *influxWriter)
+		ok    bool
+	}{
+		{"v1", func(w *influxWriter) { w.database = "meter" }, true},
+		{"v1 without database", func(w *influxWriter) {}, false},
+		{"v2", func(w *influxWriter) { w.version, w.org, w.bucket = 2, "home", "meter" }, true},
+		{"v2 without org", func(w *influxWriter) { w.version, w.bucket = 2, "meter" }, false},
+		{"v3 without org", func(w *influxWriter) { w.version, w.bucket = 3, "meter" }, true},
+		{"v3 without bucket", func(w *influxWriter) { w.version = 3 }, false},
+		{"v4", func(w *influxWriter) { w.version, w.bucket = 4, "meter" }, false},
+		{"precision", func(w *influxWriter) { w.database, w.precision = "meter", "m" }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newInfluxWriter("http://localhost:8086", 1, "s")
+			tt.setup(w)
+			if err := w.validate(); (err == nil) != tt.ok {
+				t.Errorf("validate() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestLineProtocol(t *testing.T) {
+	timestamp := time.Date(2022, 10, 17, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		frame     string
+		meterID   string // for lists without meter ID
+		label     string
+		precision time.Duration
+		want      string
+	}{
+		{
+			"kamstrup_list2", "", "", time.Second,
+			"data,meter=5706567000000000 active_power_plus=1234,active_power_minus=0,reactive_power_plus=0,reactive_power_minus=345," +
+				"l1_current=1.23,l2_current=2.34,l3_current=3.45,l1_voltage=230,l2_voltage=231,l3_voltage=229 1666000800\n",
+		},
+		{
+			// Registers missing from the list are left out
+			"aidon_list1", "7359992890941742", "heat pump, attic", time.Millisecond,
+			"data,meter=7359992890941742,label=heat\\ pump\\,\\ attic active_power_plus=1122 1666000800000\n",
+		},
+		{
+			// Unknown registers under their OBIS code, text as strings and
+			// binary octet-strings in hex. Arrays are left out.
+			"kamstrup_unknown", "", "", time.Second,
+			"data,meter=5706567000000000 active_power_plus=1234,1.0.14.7.0.255=500,1.0.98.1.0.255=-5," +
+				"1.0.97.1.0.255=\"fw 1.2\",1.0.0.2.8.255=\"deadbeef\" 1666000800\n",
+		},
+		{
+			// Scaled with the scaler sent by the meter
+			"aidon_unknown", "", "", time.Second,
+			"data,meter=7359992890941742 active_power_plus=1234,1.0.14.7.0.255=50 1666000800\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.frame, func(t *testing.T) {
+			reading := testReading(t, tt.frame, tt.label)
+			if tt.meterID != "" {
+				reading.MeterID = tt.meterID
+			}
+			if got := lineProtocol(reading, timestamp, tt.precision); got != tt.want {
+				t.Errorf("lineProtocol() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
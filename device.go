@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
+)
+
+// openDevice opens a serial device or connects to a network device
+func openDevice(device string, config *serial.Config) (io.ReadCloser, error) {
+	if isNetworkDevice(device) {
+		return openNetworkDevice(device, config)
+	}
+
+	return openSerialDevice(device, config)
+}
+
+// readDevice reads frames from device and sends them on the frames channel.
+// When the device fails it is closed and opened again with increasing
+// delays, which also picks up a USB adapter that was plugged in again under
+// another name when device is a stable /dev/serial/by-id path. Only changes
+// of the device state are logged. It does not return.
+func readDevice(device string, config *serial.Config, frames chan<- rawFrame) {
+	// Settings detected on the first open are reused when reopening
+	c := *config
+	delay := minReconnectDelay
+	connected := false
+	var lastError string
+
+	for {
+		stream, err := openDevice(device, &c)
+		if err != nil {
+			if err.Error() != lastError {
+				slog.Warn("Cannot open device, retrying", "device", device, "error", err)
+				lastError = err.Error()
+			}
+		} else {
+			msg := "Device opened"
+			if connected {
+				msg = "Device reconnected"
+			}
+			if path := resolvedName(device); path != "" {
+				slog.Info(msg, "device", device, "path", path)
+			} else {
+				slog.Info(msg, "device", device)
+			}
+			connected = true
+			delay = minReconnectDelay
+			lastError = ""
+
+			err = readFrames(stream, frames)
+			stream.Close()
+			slog.Warn("Device disconnected", "device", device, "error", err)
+		}
+
+		time.Sleep(delay)
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// resolvedName returns the device a symbolic link such as
+// /dev/serial/by-id/... points to, or "" if device is not a link
+func resolvedName(device string) string {
+	if isNetworkDevice(device) {
+		return ""
+	}
+
+	name, err := filepath.EvalSymlinks(device)
+	if err != nil || name == device {
+		return ""
+	}
+
+	return name
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/hex"
+	"math"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+
+	"kamstrup_ams_logger/ams"
+)
+
+// field is a value of a reading under its output name
+type field struct {
+	name  string
+	obis  string
+	kind  string // float, integer or string
+	value ams.Quantity
+	text  string // value of string fields
+}
+
+// readingFields returns the values of the reading written to sink, as given
+// by the OBIS mapping and scaled with its scaler. Registers the frame did not
+// carry are left out, such as the cumulative energy outside the hourly list
+// and all but the active power in the Aidon and Kaifa list 1. Numeric and
+// text registers not in the mapping follow under their OBIS code, e.g.
+// 1.0.14.7.0.255, if the mapping forwards unknown registers.
+func readingFields(reading *meterReading, sink string) []field {
+	var fields []field
+
+	for _, spec := range mapping.Fields {
+		if !spec.forwardedTo(sink) {
+			continue
+		}
+
+		f := field{name: spec.Name, obis: spec.OBIS, kind: spec.Type}
+		var ok bool
+		if spec.Type == "string" {
+			f.text, ok = reading.Text(spec.OBIS)
+		} else {
+			f.value, ok = reading.Quantity(spec.OBIS)
+			f.value.Value = ams.Scale(f.value.Value, spec.Scaler)
+			if spec.Unit != "" {
+				f.value.Unit = ams.Unit(spec.Unit)
+			}
+		}
+		if ok {
+			fields = append(fields, f)
+		}
+	}
+
+	if mapping.ForwardUnknown {
+		for _, raw := range reading.Unknown {
+			if mapping.mapped(raw.OBIS) {
+				continue
+			}
+			f := field{name: raw.OBIS, obis: raw.OBIS}
+			if q, ok := raw.Quantity(); ok {
+				f.kind, f.value = "float", q
+			} else if text, ok := rawText(raw.Value); ok {
+				f.kind, f.text = "string", text
+			} else {
+				continue
+			}
+			fields = append(fields, f)
+		}
+	}
+
+	return fields
+}
+
+// rawText returns the value of a string register. Octet-strings that are not
+// printable text, such as checksums, are given in hex.
+func rawText(v ams.Value) (string, bool) {
+	text, ok := v.Text()
+	if !ok || v.Type != ams.TypeOctetString {
+		return text, ok
+	}
+
+	printable := utf8.ValidString(text)
+	for _, r := range text {
+		printable = printable && unicode.IsPrint(r)
+	}
+	if !printable {
+		return hex.EncodeToString(v.Bytes), true
+	}
+
+	return text, true
+}
+
+// format returns the value as text, without unit
+func (f field) format() string {
+	switch f.kind {
+	case "string":
+		return f.text
+	case "integer":
+		return strconv.FormatInt(int64(math.Round(f.value.Value)), 10)
+	}
+
+	return strconv.FormatFloat(f.value.Value, 'f', -1, 64)
+}
+
+// jsonValue returns the value for encoding as JSON
+func (f field) jsonValue() interface{} {
+	switch f.kind {
+	case "string":
+		return f.text
+	case "integer":
+		return int64(math.Round(f.value.Value))
+	}
+
+	return f.value.Value
+}
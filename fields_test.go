@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"kamstrup_ams_logger/ams"
+)
+
+func TestReadingFields(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "obis.yaml")
+	err := os.WriteFile(name, []byte(`
+fields:
+  - {obis: 1.0.1.7.0.255, name: power_kw, scaler: -3, unit: kW}
+  - {obis: 1.0.32.7.0.255, name: voltage, type: integer, sinks: [mqtt]}
+  - {obis: 1.0.1.8.0.255, name: energy_kwh, scaler: -3, unit: kWh}
+  - {obis: 1.0.0.0.5.255, name: meter_id, type: string}
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaultMapping := mapping
+	defer func() { mapping = defaultMapping }()
+	if mapping, err = loadMapping(name); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		frame string
+		sink  string
+		want  []field
+	}{
+		{
+			// The energy is not in list 2 and the voltage not written to
+			// InfluxDB
+			"kamstrup_list2", "influxdb", []field{
+				{name: "power_kw", obis: "1.0.1.7.0.255", kind: "float", value: ams.Quantity{Value: 1.234, Unit: "kW"}},
+				{name: "meter_id", obis: "1.0.0.0.5.255", kind: "string", text: "5706567000000000"},
+			},
+		},
+		{
+			"kamstrup_list3", "mqtt", []field{
+				{name: "power_kw", obis: "1.0.1.7.0.255", kind: "float", value: ams.Quantity{Value: 1.234, Unit: "kW"}},
+				{name: "voltage", obis: "1.0.32.7.0.255", kind: "integer", value: ams.Quantity{Value: 230, Unit: ams.UnitVolt}},
+				{name: "energy_kwh", obis: "1.0.1.8.0.255", kind: "float", value: ams.Quantity{Value: 10000, Unit: "kWh"}},
+				{name: "meter_id", obis: "1.0.0.0.5.255", kind: "string", text: "5706567000000000"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.frame, func(t *testing.T) {
+			got := readingFields(testReading(t, tt.frame, ""), tt.sink)
+			if len(got) != len(tt.want) {
+				t.Fatalf("readingFields() = %+v, want %+v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("field %d = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// logLevels are the values of -log-level
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// setupLogging makes the logger given by the configuration the default
+// logger, which the standard log package also writes to. The returned
+// closer closes the log file, if any.
+func setupLogging(c *config) (io.Closer, error) {
+	var w io.Writer = os.Stdout
+	var closer io.Closer = io.NopCloser(nil)
+	if c.Log != "" {
+		f, err := openRotatingFile(c.Log, c.LogMaxSize*1024*1024, c.LogMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		w, closer = f, f
+	}
+
+	options := &slog.HandlerOptions{Level: logLevels[strings.ToLower(c.LogLevel)]}
+	var handler slog.Handler
+	if c.LogFormat == "json" {
+		handler = slog.NewJSONHandler(w, options)
+	} else {
+		handler = slog.NewTextHandler(w, options)
+	}
+	slog.SetDefault(slog.New(handler))
+
+	return closer, nil
+}
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// rotatingFile is a log file that is renamed to name.1 when it reaches
+// maxSize bytes, with older files shifted to name.2 up to name.<maxBackups>.
+// A maxSize of 0 disables rotation.
+type rotatingFile struct {
+	mu         sync.Mutex
+	name       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(name string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{name: name, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			// Keep logging to the current file rather than losing messages
+			fmt.Fprintf(os.Stderr, "Error rotating log file: %v\n", err)
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups and starts a new file. The file is opened again
+// even if the backups cannot be shifted, and the old file is only closed once
+// the new one is open, so it is kept if that fails.
+func (r *rotatingFile) rotate() error {
+	old := r.file
+	shiftErr := r.shiftBackups()
+	if err := r.open(); err != nil {
+		return err
+	}
+	if err := old.Close(); err != nil {
+		return err
+	}
+
+	return shiftErr
+}
+
+// shiftBackups renames the log file to name.1, after renaming name.1 to
+// name.2 and so on. Without backups the log file is removed.
+func (r *rotatingFile) shiftBackups() error {
+	if r.maxBackups == 0 {
+		if err := os.Remove(r.name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", r.name, i), fmt.Sprintf("%s.%d", r.name, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return os.Rename(r.name, r.name+".1")
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.file.Close()
+}
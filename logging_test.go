@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxSize    int64
+		maxBackups int
+		want       []string // contents of name, name.1, ...
+	}{
+		{"no rotation", 0, 3, []string{"aaaa\nbbbb\ncccc\ndddd\neeee\n"}},
+		{"backups", 10, 3, []string{"eeee\n", "cccc\ndddd\n", "aaaa\nbbbb\n"}},
+		{"oldest removed", 5, 2, []string{"eeee\n", "dddd\n", "cccc\n"}},
+		{"no backups", 10, 0, []string{"eeee\n"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "ams.log")
+			r, err := openRotatingFile(name, tt.maxSize, tt.maxBackups)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n", "eeee\n"} {
+				if n, err := r.Write([]byte(line)); n != len(line) || err != nil {
+					t.Fatalf("Write() = %d, %v", n, err)
+				}
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			files, _ := filepath.Glob(name + "*")
+			if len(files) != len(tt.want) {
+				t.Errorf("files = %v, want %d", files, len(tt.want))
+			}
+			for i, want := range tt.want {
+				file := name
+				if i > 0 {
+					file = fmt.Sprintf("%s.%d", name, i)
+				}
+				if got, err := os.ReadFile(file); err != nil || string(got) != want {
+					t.Errorf("%s = %q, %v, want %q", filepath.Base(file), got, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRotatingFileAppends(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "ams.log")
+	os.WriteFile(name, []byte("aaaa\n"), 0666)
+
+	// The size of the existing file counts towards the limit
+	r, err := openRotatingFile(name, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Write([]byte("bbbb\n"))
+	r.Write([]byte("cccc\n"))
+	r.Close()
+
+	if got, _ := os.ReadFile(name + ".1"); string(got) != "aaaa\nbbbb\n" {
+		t.Errorf("ams.log.1 = %q", got)
+	}
+	if got, _ := os.ReadFile(name); string(got) != "cccc\n" {
+		t.Errorf("ams.log = %q", got)
+	}
+}
+
+func TestRotatingFileOpenError(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "log")
+	os.Mkdir(dir, 0755)
+	name := filepath.Join(dir, "ams.log")
+
+	r, err := openRotatingFile(name, 5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Write([]byte("aaaa\n"))
+
+	// Without the directory the new file cannot be created, so the old one
+	// is written to
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr, _ = os.Open(os.DevNull)
+	n, err := r.Write([]byte("bbbb\n"))
+	os.Stderr.Close()
+	os.Stderr = stderr
+
+	if n != 5 || err != nil {
+		t.Errorf("Write() after failed rotation = %d, %v", n, err)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+}
@@ -1,99 +1,156 @@
 package main
 
 import (
-	"bytes"
-	"flag"
-	"io"
-	"log"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
-type dateTimeT struct {
-	Year        uint16
-	Month       uint8
-	Day         uint8
-	Weekday     uint8
-	Hour        uint8
-	Minute      uint8
-	Second      uint8
-	Hundreds    uint8
-	Deviation   uint16
-	ClockStatus uint8
-}
+// location is the time zone of meters that do not send their deviation from UTC
+var location *time.Location
 
-type meterDataT struct {
-	clock              dateTimeT
-	meterID            string
-	meterType          string
-	activePowerPlus    int
-	activePowerMinus   int
-	reactivePowerPlus  int
-	reactivePowerMinus int
-	l1Current          float32
-	l2Current          float32
-	l3Current          float32
-	l1Voltage          int
-	l2Voltage          int
-	l3Voltage          int
-}
+func main() {
+	cfg, printConfig, err := loadConfig(os.Args[1:])
+	if err != nil {
+		fatal("Error reading configuration", "error", err)
+	}
 
-var device *string
-var influxURL *string
-var dbname *string
-var logfile *string
+	// The configuration is printed before it is validated, to help finding
+	// the problem
+	if printConfig {
+		if err := cfg.print(os.Stdout); err != nil {
+			fatal("Error printing configuration", "error", err)
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		// Printed as is, the problems are listed one per line
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if mapping, err = loadMapping(cfg.OBISConfig); err != nil {
+		fatal("Invalid OBIS mapping", "error", err)
+	}
+	if printConfig {
+		return
+	}
 
-var meter meterDataT
+	// Validated above
+	location, _ = time.LoadLocation(cfg.Timezone)
 
-func main() {
-	var outputBuffer bytes.Buffer
-	buffer := make([]byte, 1024)
+	logFile, err := setupLogging(&cfg)
+	if err != nil {
+		fatal("Error opening log file", "file", cfg.Log, "error", err)
+	}
+	defer logFile.Close()
 
-	device = flag.String("device", "/dev/ttyUSB0", "serial device name")
-	influxURL = flag.String("url", "http://localhost:8086", "InfluxDB URL")
-	dbname = flag.String("dbname", "meter", "InfluxDB database name")
-	logfile = flag.String("log", "", "Debug log")
-	flag.Parse()
+	var sinks []Sink
+	var queue *diskQueue
 
-	if *logfile != "" {
-		f, err := os.OpenFile(*logfile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-		if err != nil {
-			log.Fatalf("Error opening file: %v", err)
+	if cfg.InfluxDB.URL != "" {
+		influx := cfg.newInfluxWriter()
+
+		if cfg.InfluxDB.Queue != "" {
+			queue, err = openDiskQueue(cfg.InfluxDB.Queue, cfg.InfluxDB.QueueMaxSize*1024*1024)
+			if err != nil {
+				fatal("Error opening queue", "dir", cfg.InfluxDB.Queue, "error", err)
+			}
+			sinks = append(sinks, newBufferedWriter(influx, queue))
+		} else {
+			sinks = append(sinks, influx)
 		}
-		log.SetOutput(f)
-		defer f.Close()
-	} else {
-		log.SetOutput(os.Stdout)
 	}
 
-	stream, err := openSerialDevice(*device)
-	if err != nil {
-		log.Fatalf("Error opening serial port: %s", err.Error())
+	if cfg.MQTT.Broker != "" {
+		publisher, err := newMQTTPublisher(mqttOptions{
+			broker:          cfg.MQTT.Broker,
+			clientID:        cfg.MQTT.ClientID,
+			username:        cfg.MQTT.Username,
+			password:        cfg.MQTT.Password,
+			caFile:          cfg.MQTT.CA,
+			insecure:        cfg.MQTT.Insecure,
+			topic:           cfg.MQTT.Topic,
+			retain:          cfg.MQTT.Retain,
+			discoveryPrefix: cfg.MQTT.Discovery,
+		})
+		if err != nil {
+			fatal("Error setting up MQTT", "error", err)
+		}
+		sinks = append(sinks, publisher)
 	}
 
-	defer stream.Close()
+	if cfg.Archive.Dir != "" {
+		archive, err := newArchiveWriter(cfg.Archive.Dir, cfg.Archive.Format, cfg.Archive.MaxSize*1024*1024, cfg.Archive.Gzip)
+		if err != nil {
+			fatal("Error setting up archive", "error", err)
+		}
+		sinks = append(sinks, archive)
+	}
 
-	log.Println("Serial port opened")
+	var exporter *prometheusExporter
+	if cfg.Metrics.Listen != "" {
+		exporter = newPrometheusExporter()
+		sinks = append(sinks, exporter)
+	}
 
-	for {
-		numBytes, err := stream.Read(buffer)
-		if err != nil && err != io.EOF {
-			log.Printf("Error reading data from serial device: %v", err)
-		} else if err == io.EOF && outputBuffer.Len() > 0 {
-			// Last byte received in this stream
-			log.Printf("%d bytes received", outputBuffer.Len())
+	if len(sinks) == 0 {
+		slog.Warn("No output configured, readings are only logged at debug level")
+	}
+	output := newFanOut(sinks)
 
-			err := decodeData(outputBuffer)
-			if err != nil {
-				log.Printf("Error decoding data: %v", err)
-			}
+	if exporter != nil {
+		exporter.output = output
+		exporter.queue = queue
+		go exporter.listen(cfg.Metrics.Listen)
+	}
 
-			writeToDatabase()
-			outputBuffer.Reset()
+	var capture *captureWriter
+	if cfg.Capture != "" {
+		capture, err = openCapture(cfg.Capture)
+		if err != nil {
+			fatal("Error opening capture file", "file", cfg.Capture, "error", err)
 		}
+		defer capture.close()
+	}
 
-		if numBytes > 0 {
-			bytesRead := buffer[0:numBytes]
-			outputBuffer.Write(bytesRead)
+	if cfg.Replay != "" {
+		slog.Info("Replaying capture", "file", cfg.Replay)
+		if err := replay(&cfg, output, capture); err != nil {
+			fatal("Error replaying capture", "file", cfg.Replay, "error", err)
 		}
+		slog.Info("Replay finished")
+		return
+	}
+
+	for _, c := range cfg.meters() {
+		go newMeter(c).run(output, capture)
+	}
+
+	// Stop on a signal, closing the files of the sinks
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	sig := <-stop
+	slog.Info("Stopping", "signal", sig.String())
+	output.closeSinks()
+}
+
+// parseKey parses an AES-128 key given in hex. An empty string is no key.
+func parseKey(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
 	}
+
+	key, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 16 {
+		return nil, fmt.Errorf("key must be 16 bytes, got %d", len(key))
+	}
+
+	return key, nil
 }
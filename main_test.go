@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"kamstrup_ams_logger/ams"
+)
+
+func TestMain(m *testing.M) {
+	var err error
+	if mapping, err = loadMapping(""); err != nil {
+		panic(err)
+	}
+	location = time.UTC
+
+	os.Exit(m.Run())
+}
+
+// testFrame returns a frame from the testdata of the ams package
+func testFrame(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("ams", "testdata", name+".hex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return frame
+}
+
+// testReading decodes a frame from the testdata of the ams package
+func testReading(t *testing.T, name string, label string) *meterReading {
+	t.Helper()
+
+	reading, err := ams.Decode(testFrame(t, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &meterReading{Reading: reading, label: label}
+}
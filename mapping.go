@@ -0,0 +1,145 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultMapping is the mapping used without -obis-config, see obis.yaml
+//
+//go:embed obis.yaml
+var defaultMapping []byte
+
+// sinkIDs are the output names used in the sinks list of the mapping
+var sinkIDs = []string{"influxdb", "mqtt", "prometheus", "archive"}
+
+// obisMapping maps OBIS codes to output fields
+type obisMapping struct {
+	ForwardUnknown bool        `yaml:"forward_unknown"`
+	Fields         []fieldSpec `yaml:"fields"`
+}
+
+// fieldSpec is an entry of the OBIS mapping
+type fieldSpec struct {
+	OBIS   string   `yaml:"obis"`
+	Name   string   `yaml:"name"`
+	Type   string   `yaml:"type"`
+	Scaler int      `yaml:"scaler"`
+	Unit   string   `yaml:"unit"`
+	Sinks  []string `yaml:"sinks"`
+}
+
+// mapping is the OBIS mapping in use
+var mapping *obisMapping
+
+// loadMapping reads the OBIS mapping from name, or the default mapping if
+// name is empty
+func loadMapping(name string) (*obisMapping, error) {
+	data := defaultMapping
+	if name != "" {
+		var err error
+		if data, err = os.ReadFile(name); err != nil {
+			return nil, err
+		}
+	}
+
+	var m obisMapping
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// validate checks the mapping and normalises the OBIS codes and types
+func (m *obisMapping) validate() error {
+	names := make(map[string]bool)
+	codes := make(map[string]bool)
+
+	for i := range m.Fields {
+		f := &m.Fields[i]
+
+		obisID, err := normaliseOBIS(f.OBIS)
+		if err != nil {
+			return fmt.Errorf("field %d: %v", i+1, err)
+		}
+		f.OBIS = obisID
+
+		switch {
+		case f.Name == "":
+			return fmt.Errorf("field %d (%s): no name", i+1, f.OBIS)
+		case names[f.Name]:
+			return fmt.Errorf("field %d (%s): duplicate name %s", i+1, f.OBIS, f.Name)
+		case codes[f.OBIS]:
+			return fmt.Errorf("field %d (%s): OBIS code mapped twice", i+1, f.OBIS)
+		}
+		names[f.Name] = true
+		codes[f.OBIS] = true
+
+		if f.Type == "" {
+			f.Type = "float"
+		}
+		if f.Type != "float" && f.Type != "integer" && f.Type != "string" {
+			return fmt.Errorf("field %d (%s): invalid type %q, must be float, integer or string", i+1, f.Name, f.Type)
+		}
+
+		for _, sink := range f.Sinks {
+			if !contains(sinkIDs, sink) {
+				return fmt.Errorf("field %d (%s): unknown sink %q, must be one of %s", i+1, f.Name, sink, strings.Join(sinkIDs, ", "))
+			}
+		}
+	}
+
+	return nil
+}
+
+// normaliseOBIS checks an OBIS code and sets its B group to 0, as done by
+// the decoder
+func normaliseOBIS(s string) (string, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 6 {
+		return "", fmt.Errorf("invalid OBIS code %q, must be A.B.C.D.E.F", s)
+	}
+	for _, p := range parts {
+		if n, err := strconv.Atoi(p); err != nil || n < 0 || n > 255 {
+			return "", fmt.Errorf("invalid OBIS code %q, must be A.B.C.D.E.F", s)
+		}
+	}
+	parts[1] = "0"
+
+	return strings.Join(parts, "."), nil
+}
+
+// forwardedTo reports whether the field is written to sink
+func (f *fieldSpec) forwardedTo(sink string) bool {
+	return len(f.Sinks) == 0 || contains(f.Sinks, sink)
+}
+
+// mapped reports whether the OBIS code has an entry in the mapping
+func (m *obisMapping) mapped(obisID string) bool {
+	for _, f := range m.Fields {
+		if f.OBIS == obisID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/tarm/serial"
+
+	"kamstrup_ams_logger/ams"
+)
+
+// meter is a meter read from its own device
+type meter struct {
+	label   string
+	device  string
+	serial  *serial.Config
+	decoder ams.Decoder
+}
+
+// newMeter returns the meter of a validated meter configuration
+func newMeter(c meterConfig) *meter {
+	m := &meter{label: c.Label, device: c.Device}
+	m.serial, _ = c.serialConfig()
+	m.decoder.EncryptionKey, _ = parseKey(c.EncryptionKey)
+	m.decoder.AuthenticationKey, _ = parseKey(c.AuthenticationKey)
+
+	return m
+}
+
+// run reads the device of the meter and writes its readings to output. It
+// never returns.
+func (m *meter) run(output *fanOut, capture *captureWriter) {
+	frames := make(chan rawFrame)
+	go readDevice(m.device, m.serial, frames)
+
+	processFrames(m.label, &m.decoder, frames, output, capture)
+}
+
+// processFrames decodes the frames of a meter until the channel is closed
+// and writes the readings to output, labelled with label. Frames and
+// readings are only logged at debug level. Lists that leave out the meter ID
+// and type get those of the last list that carried them; readings before
+// the meter ID is known are skipped.
+func processFrames(label string, decoder *ams.Decoder, frames <-chan rawFrame, output *fanOut, capture *captureWriter) {
+	logger := slog.Default()
+	if label != "" {
+		logger = logger.With("meter", label)
+	}
+	debug := logger.Enabled(context.Background(), slog.LevelDebug)
+	var meterID, meterType string
+
+	for frame := range frames {
+		framesReceived.Add(1)
+		if debug {
+			logger.Debug("Frame received", "bytes", len(frame.data), "data", hex.EncodeToString(frame.data))
+		}
+
+		if capture != nil {
+			if err := capture.write(label, frame); err != nil {
+				logger.Error("Error writing capture file", "error", err)
+			}
+		}
+
+		reading, err := decoder.Decode(frame.data)
+		if errors.Is(err, ams.ErrChecksum) {
+			rejected := checksumErrors.Add(1)
+			logger.Warn("Frame rejected", "error", err, "rejected", rejected)
+		} else if err != nil {
+			decodeErrors.Add(1)
+			logger.Warn("Error decoding data", "error", err)
+		} else {
+			if debug {
+				logger.Debug("Meter data", "reading", fmt.Sprintf("%+v", *reading))
+			}
+
+			if reading.MeterID != "" {
+				meterID, meterType = reading.MeterID, reading.MeterType
+			} else if meterID != "" {
+				reading.MeterID, reading.MeterType = meterID, meterType
+			} else {
+				logger.Debug("Meter ID not known yet, reading skipped")
+				continue
+			}
+
+			timestamp, err := reading.Time(location)
+			if err != nil {
+				logger.Debug("Using receive time", "reason", err)
+				timestamp = frame.received
+			}
+
+			output.write(&meterReading{Reading: reading, label: label}, timestamp)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Frame counters, exposed as process metrics
+var (
+	framesReceived atomic.Int64
+	decodeErrors   atomic.Int64
+	checksumErrors atomic.Int64
+)
+
+// promMetric is the Prometheus metric a reading field is exported as
+type promMetric struct {
+	name  string
+	help  string
+	label string
+	value string
+}
+
+// promMetrics maps OBIS codes to metrics, so renaming or scaling fields in
+// the OBIS mapping does not change the metrics. Metrics ending in _total are
+// counters, all others gauges.
+var promMetrics = map[string]promMetric{
+	"1.0.1.7.0.255":  {"ams_active_power_watts", "Active power", "direction", "import"},
+	"1.0.2.7.0.255":  {"ams_active_power_watts", "Active power", "direction", "export"},
+	"1.0.3.7.0.255":  {"ams_reactive_power_var", "Reactive power", "direction", "import"},
+	"1.0.4.7.0.255":  {"ams_reactive_power_var", "Reactive power", "direction", "export"},
+	"1.0.31.7.0.255": {"ams_current_amperes", "Phase current", "phase", "L1"},
+	"1.0.51.7.0.255": {"ams_current_amperes", "Phase current", "phase", "L2"},
+	"1.0.71.7.0.255": {"ams_current_amperes", "Phase current", "phase", "L3"},
+	"1.0.32.7.0.255": {"ams_voltage_volts", "Phase voltage", "phase", "L1"},
+	"1.0.52.7.0.255": {"ams_voltage_volts", "Phase voltage", "phase", "L2"},
+	"1.0.72.7.0.255": {"ams_voltage_volts", "Phase voltage", "phase", "L3"},
+	"1.0.1.8.0.255":  {"ams_active_energy_watt_hours_total", "Cumulative active energy", "direction", "import"},
+	"1.0.2.8.0.255":  {"ams_active_energy_watt_hours_total", "Cumulative active energy", "direction", "export"},
+	"1.0.3.8.0.255":  {"ams_reactive_energy_var_hours_total", "Cumulative reactive energy", "direction", "import"},
+	"1.0.4.8.0.255":  {"ams_reactive_energy_var_hours_total", "Cumulative reactive energy", "direction", "export"},
+}
+
+// promRegister is the metric of fields without an entry in promMetrics,
+// labelled with the OBIS code
+var promRegister = promMetric{"ams_register_value", "Value of a register without a dedicated metric, in its base unit", "obis", ""}
+
+// promSample is a single line of the exposition format
+type promSample struct {
+	labels string
+	value  float64
+}
+
+// prometheusExporter keeps the latest values of every meter and serves them
+// together with the process metrics on /metrics. Cumulative energy is only
+// sent in the hourly list, the last value is kept in between.
+type prometheusExporter struct {
+	mu      sync.Mutex
+	samples map[string]map[string]promSample // metric name, series key
+	updated map[string]promSample            // last reading time by meter ID
+
+	// Set once the sinks are created
+	output *fanOut
+	queue  *diskQueue
+}
+
+func newPrometheusExporter() *prometheusExporter {
+	return &prometheusExporter{
+		samples: make(map[string]map[string]promSample),
+		updated: make(map[string]promSample),
+	}
+}
+
+func (e *prometheusExporter) name() string {
+	return "Prometheus"
+}
+
+func (e *prometheusExporter) write(reading *meterReading, timestamp time.Time) error {
+	meterLabels := promLabel("meter_id", reading.MeterID) + "," + promLabel("meter_type", reading.MeterType)
+	if reading.label != "" {
+		meterLabels += "," + promLabel("label", reading.label)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// The mapping selects the registers, the values are always exported in
+	// the base unit the metrics are named with
+	for _, f := range readingFields(reading, "prometheus") {
+		q, ok := reading.Quantity(f.obis)
+		if f.kind == "string" || !ok {
+			continue
+		}
+		m, ok := promMetrics[f.obis]
+		if !ok {
+			m = promRegister
+			m.value = f.obis
+		}
+		labels := meterLabels + "," + promLabel(m.label, m.value)
+		if e.samples[m.name] == nil {
+			e.samples[m.name] = make(map[string]promSample)
+		}
+		e.samples[m.name][labels] = promSample{labels, q.Value}
+	}
+	e.updated[reading.MeterID] = promSample{meterLabels, float64(timestamp.UnixNano()) / 1e9}
+
+	return nil
+}
+
+// listen serves the metrics on addr. It does not return.
+func (e *prometheusExporter) listen(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", e.serveMetrics)
+
+	slog.Info("Serving metrics", "url", addr+"/metrics")
+	err := http.ListenAndServe(addr, mux)
+	fatal("Error serving metrics", "listen", addr, "error", err)
+}
+
+func (e *prometheusExporter) serveMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	e.mu.Lock()
+	names := make([]string, 0, len(e.samples))
+	for name := range e.samples {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		help := promRegister.help
+		for _, m := range promMetrics {
+			if m.name == name {
+				help = m.help
+			}
+		}
+		writeMetric(w, name, help, sortedSamples(e.samples[name]))
+	}
+	writeMetric(w, "ams_last_reading_timestamp_seconds", "Time of the last reading", sortedSamples(e.updated))
+	e.mu.Unlock()
+
+	writeMetric(w, "ams_frames_received_total", "Frames received", []promSample{{"", float64(framesReceived.Load())}})
+	writeMetric(w, "ams_frame_decode_errors_total", "Frames that could not be decoded", []promSample{{"", float64(decodeErrors.Load())}})
+	writeMetric(w, "ams_frame_checksum_errors_total", "Frames rejected because of a checksum mismatch", []promSample{{"", float64(checksumErrors.Load())}})
+
+	if e.output != nil {
+		var failures, dropped []promSample
+		for _, worker := range e.output.workers {
+			labels := promLabel("sink", worker.sink.name())
+			failures = append(failures, promSample{labels, float64(worker.failures.Load())})
+			dropped = append(dropped, promSample{labels, float64(worker.dropped.Load())})
+		}
+		writeMetric(w, "ams_sink_failures_total", "Failed writes per sink", failures)
+		writeMetric(w, "ams_sink_dropped_total", "Readings dropped because a sink did not keep up", dropped)
+	}
+
+	if e.queue != nil {
+		points, size := e.queue.depth()
+		writeMetric(w, "ams_queue_points", "Points queued for InfluxDB", []promSample{{"", float64(points)}})
+		writeMetric(w, "ams_queue_bytes", "Size of the InfluxDB queue", []promSample{{"", float64(size)}})
+	}
+}
+
+func sortedSamples(series map[string]promSample) []promSample {
+	samples := make([]promSample, 0, len(series))
+	for _, s := range series {
+		samples = append(samples, s)
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].labels < samples[j].labels })
+
+	return samples
+}
+
+// labelEscaper escapes label values as the exposition format requires, which
+// unlike Go quoting leaves other characters as they are
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promLabel returns a label pair of the exposition format
+func promLabel(name, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+// writeMetric writes a metric in the Prometheus text exposition format
+func writeMetric(w io.Writer, name string, help string, samples []promSample) {
+	metricType := "gauge"
+	if strings.HasSuffix(name, "_total") {
+		metricType = "counter"
+	}
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+	for _, s := range samples {
+		value := strconv.FormatFloat(s.value, 'g', -1, 64)
+		if s.labels == "" {
+			fmt.Fprintf(w, "%s %s\n", name, value)
+		} else {
+			fmt.Fprintf(w, "%s{%s} %s\n", name, s.labels, value)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPromLabel(t *testing.T) {
+	tests := map[string]string{
+		"house":             `label="house"`,
+		`say "hi"`:          `label="say \"hi\""`,
+		`C:\meter`:          `label="C:\\meter"`,
+		"two\nlines":        `label="two\nlines"`,
+		"tab\tand æøå\x01!": "label=\"tab\tand æøå\x01!\"",
+	}
+
+	for value, want := range tests {
+		if got := promLabel("label", value); got != want {
+			t.Errorf("promLabel(%q) = %s, want %s", value, got, want)
+		}
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	e := newPrometheusExporter()
+	e.output = newFanOut([]Sink{&slowSink{}})
+	defer e.output.close()
+
+	timestamp := time.Date(2022, 10, 17, 10, 0, 0, 0, time.UTC)
+	for _, frame := range []string{"kamstrup_list3", "kamstrup_unknown"} {
+		if err := e.write(testReading(t, frame, "garage \"east\"\nwing"), timestamp); err != nil {
+			t.Fatalf("write() error = %v", err)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	e.serveMetrics(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+
+	if ct := recorder.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	meter := `meter_id="5706567000000000",meter_type="6841121BN243101040",label="garage \"east\"\nwing"`
+	for _, want := range []string{
+		"# HELP ams_active_power_watts Active power\n# TYPE ams_active_power_watts gauge\n",
+		"ams_active_power_watts{" + meter + `,direction="import"} 1234` + "\n",
+		"# TYPE ams_active_energy_watt_hours_total counter\n",
+		"ams_active_energy_watt_hours_total{" + meter + `,direction="import"} 1e+07` + "\n",
+		"ams_current_amperes{" + meter + `,phase="L1"} 1.23` + "\n",
+		`label="garage \"east\"\nwing",obis="1.0.14.7.0.255"} 500` + "\n",
+		`label="garage \"east\"\nwing"} 1.6660008e+09` + "\n",
+		"# TYPE ams_frames_received_total counter\n",
+		`ams_sink_failures_total{sink="slow"} 0` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, body)
+		}
+	}
+
+	// Text registers are not exported
+	if strings.Contains(body, "1.0.97.1.0.255") {
+		t.Errorf("metrics contain a string register:\n%s", body)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"kamstrup_ams_logger/ams"
+)
+
+const mqttTimeout = 10 * time.Second
+
+// mqttPublisher publishes readings to an MQTT broker. Every reading is
+// published as a JSON object on <topic>/<meter ID>/state and every field on
+// <topic>/<meter ID>/<field>. The availability of the logger is published on
+// <topic>/status, with a last will marking it offline.
+//
+// When a discovery prefix is set, Home Assistant discovery config is
+// published for every field the first time it is seen.
+type mqttPublisher struct {
+	client          mqtt.Client
+	topic           string
+	retain          bool
+	discoveryPrefix string
+
+	mu        sync.Mutex
+	announced map[string]bool
+}
+
+type mqttOptions struct {
+	broker          string // tcp://host:1883, ssl://host:8883 or ws://host/mqtt
+	clientID        string
+	username        string
+	password        string
+	caFile          string
+	insecure        bool
+	topic           string
+	retain          bool
+	discoveryPrefix string
+}
+
+func newMQTTPublisher(o mqttOptions) (*mqttPublisher, error) {
+	p := &mqttPublisher{
+		topic:           strings.TrimSuffix(o.topic, "/"),
+		retain:          o.retain,
+		discoveryPrefix: strings.TrimSuffix(o.discoveryPrefix, "/"),
+		announced:       make(map[string]bool),
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(o.broker).
+		SetClientID(o.clientID).
+		SetUsername(o.username).
+		SetPassword(o.password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetWill(p.statusTopic(), "offline", 1, true).
+		SetOnConnectHandler(p.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Warn("MQTT connection lost", "error", err)
+		})
+
+	if o.caFile != "" || o.insecure {
+		config := &tls.Config{InsecureSkipVerify: o.insecure}
+		if o.caFile != "" {
+			ca, err := os.ReadFile(o.caFile)
+			if err != nil {
+				return nil, err
+			}
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("no certificates found in %s", o.caFile)
+			}
+		}
+		opts.SetTLSConfig(config)
+	}
+
+	p.client = mqtt.NewClient(opts)
+
+	// With connect retry the client keeps trying in the background, so a
+	// broker that is down at startup does not stop the logger
+	p.client.Connect()
+
+	return p, nil
+}
+
+func (p *mqttPublisher) name() string {
+	return "MQTT"
+}
+
+func (p *mqttPublisher) statusTopic() string {
+	return p.topic + "/status"
+}
+
+func (p *mqttPublisher) onConnect(client mqtt.Client) {
+	slog.Info("MQTT connected")
+
+	// Announce again, the broker may have lost the retained discovery config
+	p.mu.Lock()
+	p.announced = make(map[string]bool)
+	p.mu.Unlock()
+
+	client.Publish(p.statusTopic(), 1, true, "online")
+}
+
+func (p *mqttPublisher) write(reading *meterReading, timestamp time.Time) error {
+	if !p.client.IsConnectionOpen() {
+		return fmt.Errorf("not connected to broker")
+	}
+
+	meterTopic := p.topic + "/" + topicLevel(reading.MeterID)
+	fields := readingFields(reading, "mqtt")
+
+	state := map[string]interface{}{
+		"time":       timestamp.Format(time.RFC3339),
+		"meter_id":   reading.MeterID,
+		"meter_type": reading.MeterType,
+	}
+	if reading.label != "" {
+		state["label"] = reading.label
+	}
+	for _, f := range fields {
+		state[f.name] = f.jsonValue()
+	}
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	if p.discoveryPrefix != "" {
+		if err := p.announce(reading, fields, meterTopic); err != nil {
+			return err
+		}
+	}
+
+	if err := p.publish(meterTopic+"/state", payload); err != nil {
+		return err
+	}
+	for _, f := range fields {
+		if err := p.publish(meterTopic+"/"+f.name, []byte(f.format())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *mqttPublisher) publish(topic string, payload []byte) error {
+	token := p.client.Publish(topic, 0, p.retain, payload)
+	if !token.WaitTimeout(mqttTimeout) {
+		return fmt.Errorf("timeout publishing to %s", topic)
+	}
+
+	return token.Error()
+}
+
+// haSensor is the Home Assistant MQTT discovery config of a sensor
+type haSensor struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	ObjectID          string   `json:"object_id"`
+	StateTopic        string   `json:"state_topic"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	StateClass        string   `json:"state_class,omitempty"`
+	Unit              string   `json:"unit_of_measurement,omitempty"`
+	Device            haDevice `json:"device"`
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+}
+
+// haClasses maps units to the Home Assistant device class. Energy units are
+// cumulative counters, everything else is a measurement.
+var haClasses = map[ams.Unit]string{
+	ams.UnitWatt:       "power",
+	ams.UnitVar:        "reactive_power",
+	ams.UnitVoltAmpere: "apparent_power",
+	ams.UnitAmpere:     "current",
+	ams.UnitVolt:       "voltage",
+	ams.UnitWattHour:   "energy",
+	ams.UnitVarHour:    "",
+	ams.UnitHertz:      "frequency",
+}
+
+// announce publishes discovery config for the fields not announced before
+func (p *mqttPublisher) announce(reading *meterReading, fields []field, meterTopic string) error {
+	nodeID := topicLevel(reading.MeterID)
+	name := reading.label
+	if name == "" {
+		name = strings.TrimSpace(reading.Vendor + " " + reading.MeterID)
+	}
+	device := haDevice{
+		Identifiers:  []string{"ams_" + nodeID},
+		Name:         name,
+		Manufacturer: reading.Vendor,
+		Model:        reading.MeterType,
+	}
+
+	for _, f := range fields {
+		// Home Assistant only allows letters, digits, _ and - in IDs,
+		// fields of unknown registers are named by OBIS code with dots
+		objectID := strings.ReplaceAll(f.name, ".", "_")
+		uniqueID := "ams_" + nodeID + "_" + objectID
+
+		p.mu.Lock()
+		done := p.announced[uniqueID]
+		p.mu.Unlock()
+		if done {
+			continue
+		}
+
+		// Text sensors have no state class
+		stateClass := "measurement"
+		if f.kind == "string" {
+			stateClass = ""
+		} else if f.value.Unit == ams.UnitWattHour || f.value.Unit == ams.UnitVarHour {
+			stateClass = "total_increasing"
+		}
+
+		config, err := json.Marshal(haSensor{
+			Name:              strings.ReplaceAll(f.name, "_", " "),
+			UniqueID:          uniqueID,
+			ObjectID:          uniqueID,
+			StateTopic:        meterTopic + "/" + f.name,
+			AvailabilityTopic: p.statusTopic(),
+			DeviceClass:       haClasses[f.value.Unit],
+			StateClass:        stateClass,
+			Unit:              string(f.value.Unit),
+			Device:            device,
+		})
+		if err != nil {
+			return err
+		}
+
+		token := p.client.Publish(p.discoveryPrefix+"/sensor/"+nodeID+"/"+objectID+"/config", 1, true, config)
+		if !token.WaitTimeout(mqttTimeout) {
+			return fmt.Errorf("timeout publishing discovery config")
+		}
+		if err := token.Error(); err != nil {
+			return err
+		}
+
+		p.mu.Lock()
+		p.announced[uniqueID] = true
+		p.mu.Unlock()
+	}
+
+	return nil
+}
+
+// topicLevel makes s usable as a single MQTT topic level
+func topicLevel(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '+', '#', ' ':
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mqttMessage is a message received by the MQTT stand-in
+type mqttMessage struct {
+	topic   string
+	payload string
+	qos     byte
+	retain  bool
+}
+
+// mqttBroker is an in-process MQTT 3.1.1 broker stand-in. It accepts every
+// client, records the published messages and the last will of the client.
+type mqttBroker struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	messages []mqttMessage
+	will     *mqttMessage
+	conns    []net.Conn
+}
+
+func newMQTTBroker(t *testing.T) *mqttBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &mqttBroker{listener: listener}
+	t.Cleanup(b.close)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.conns = append(b.conns, conn)
+			b.mu.Unlock()
+			go b.serve(conn)
+		}
+	}()
+
+	return b
+}
+
+func (b *mqttBroker) url() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+func (b *mqttBroker) close() {
+	b.listener.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, conn := range b.conns {
+		conn.Close()
+	}
+}
+
+func (b *mqttBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	for {
+		header, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return
+		}
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(r, packet); err != nil {
+			return
+		}
+
+		switch header >> 4 {
+		case 1: // CONNECT
+			b.mu.Lock()
+			b.will = parseWill(packet)
+			b.mu.Unlock()
+			conn.Write([]byte{0x20, 2, 0, 0})
+		case 3: // PUBLISH
+			qos := header >> 1 & 3
+			topic, rest := mqttString(packet)
+			if qos > 0 {
+				conn.Write([]byte{0x40, 2, rest[0], rest[1]})
+				rest = rest[2:]
+			}
+			b.mu.Lock()
+			b.messages = append(b.messages, mqttMessage{topic, string(rest), qos, header&1 == 1})
+			b.mu.Unlock()
+		case 8: // SUBSCRIBE
+			conn.Write([]byte{0x90, 3, packet[0], packet[1], 0})
+		case 12: // PINGREQ
+			conn.Write([]byte{0xd0, 0})
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+// parseWill returns the last will of a CONNECT packet, or nil
+func parseWill(packet []byte) *mqttMessage {
+	_, rest := mqttString(packet) // protocol name
+	flags := rest[1]
+	_, rest = mqttString(rest[4:]) // client ID
+	if flags&0x04 == 0 {
+		return nil
+	}
+
+	topic, rest := mqttString(rest)
+	payload, _ := mqttString(rest)
+	return &mqttMessage{topic, payload, flags >> 3 & 3, flags&0x20 != 0}
+}
+
+// mqttString reads a string with a 16 bit length
+func mqttString(b []byte) (string, []byte) {
+	n := int(binary.BigEndian.Uint16(b))
+	return string(b[2 : 2+n]), b[2+n:]
+}
+
+// waitFor waits until a message was published on topic and returns the last
+// one
+func (b *mqttBroker) waitFor(t *testing.T, topic string) mqttMessage {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if m, n := b.find(topic); n > 0 {
+			return m
+		}
+	}
+	t.Fatalf("no message published on %s", topic)
+	return mqttMessage{}
+}
+
+// find returns the last message published on topic and the number of
+// messages published on it
+func (b *mqttBroker) find(topic string) (mqttMessage, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var last mqttMessage
+	n := 0
+	for _, m := range b.messages {
+		if m.topic == topic {
+			last = m
+			n++
+		}
+	}
+
+	return last, n
+}
+
+func newTestPublisher(t *testing.T, broker *mqttBroker) *mqttPublisher {
+	p, err := newMQTTPublisher(mqttOptions{
+		broker:          broker.url(),
+		clientID:        "test",
+		topic:           "ams/",
+		retain:          true,
+		discoveryPrefix: "homeassistant",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.client.Disconnect(100) })
+
+	for deadline := time.Now().Add(5 * time.Second); !p.client.IsConnectionOpen(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("not connected to broker")
+		}
+	}
+
+	return p
+}
+
+func TestMQTTStatus(t *testing.T) {
+	broker := newMQTTBroker(t)
+	newTestPublisher(t, broker)
+
+	// Online on connect, offline as last will, both retained
+	online := broker.waitFor(t, "ams/status")
+	if online != (mqttMessage{"ams/status", "online", 1, true}) {
+		t.Errorf("status = %+v", online)
+	}
+
+	broker.mu.Lock()
+	will := broker.will
+	broker.mu.Unlock()
+	if will == nil || *will != (mqttMessage{"ams/status", "offline", 1, true}) {
+		t.Errorf("last will = %+v", will)
+	}
+}
+
+func TestMQTTPublish(t *testing.T) {
+	broker := newMQTTBroker(t)
+	p := newTestPublisher(t, broker)
+	timestamp := time.Date(2022, 10, 17, 10, 0, 0, 0, time.UTC)
+
+	if err := p.write(testReading(t, "kamstrup_list3", "house"), timestamp); err != nil {
+		t.Fatalf("write() error = %v", err)
+	}
+
+	// State with all fields
+	m := broker.waitFor(t, "ams/5706567000000000/state")
+	if !m.retain || m.qos != 0 {
+		t.Errorf("state published with qos %d, retain %v", m.qos, m.retain)
+	}
+	var state map[string]interface{}
+	if err := json.Unmarshal([]byte(m.payload), &state); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"time":               "2022-10-17T10:00:00Z",
+		"meter_id":           "5706567000000000",
+		"meter_type":         "6841121BN243101040",
+		"label":              "house",
+		"active_power_plus":  1234.0,
+		"l1_current":         1.23,
+		"l3_voltage":         229.0,
+		"active_energy_plus": 1e7,
+	}
+	for key, value := range want {
+		if state[key] != value {
+			t.Errorf("state[%s] = %v, want %v", key, state[key], value)
+		}
+	}
+	if len(state) != 4+14 {
+		t.Errorf("state has %d keys, want 18: %v", len(state), state)
+	}
+
+	// Every field on its own topic
+	for topic, payload := range map[string]string{
+		"ams/5706567000000000/active_power_plus":     "1234",
+		"ams/5706567000000000/l1_current":            "1.23",
+		"ams/5706567000000000/reactive_energy_minus": "30000",
+	} {
+		if m := broker.waitFor(t, topic); m.payload != payload || !m.retain {
+			t.Errorf("%s = %q, retain %v, want %q", topic, m.payload, m.retain, payload)
+		}
+	}
+}
+
+func TestMQTTDiscovery(t *testing.T) {
+	broker := newMQTTBroker(t)
+	p := newTestPublisher(t, broker)
+	reading := testReading(t, "kamstrup_list3", "house")
+
+	for i := 0; i < 2; i++ {
+		if err := p.write(reading, time.Now()); err != nil {
+			t.Fatalf("write() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		field       string
+		deviceClass string
+		stateClass  string
+		unit        string
+	}{
+		{"active_power_plus", "power", "measurement", "W"},
+		{"reactive_power_minus", "reactive_power", "measurement", "var"},
+		{"l2_current", "current", "measurement", "A"},
+		{"l1_voltage", "voltage", "measurement", "V"},
+		{"active_energy_plus", "energy", "total_increasing", "Wh"},
+		{"reactive_energy_plus", "", "total_increasing", "varh"},
+	}
+
+	for _, tt := range tests {
+		topic := "homeassistant/sensor/5706567000000000/" + tt.field + "/config"
+		m := broker.waitFor(t, topic)
+		if !m.retain || m.qos != 1 {
+			t.Errorf("%s published with qos %d, retain %v", topic, m.qos, m.retain)
+		}
+
+		var config haSensor
+		if err := json.Unmarshal([]byte(m.payload), &config); err != nil {
+			t.Fatal(err)
+		}
+		if config.DeviceClass != tt.deviceClass || config.StateClass != tt.stateClass || config.Unit != tt.unit {
+			t.Errorf("%s: device class %q, state class %q, unit %q, want %q, %q, %q", tt.field,
+				config.DeviceClass, config.StateClass, config.Unit, tt.deviceClass, tt.stateClass, tt.unit)
+		}
+		if config.StateTopic != "ams/5706567000000000/"+tt.field || config.AvailabilityTopic != "ams/status" {
+			t.Errorf("%s: state topic %q, availability topic %q", tt.field, config.StateTopic, config.AvailabilityTopic)
+		}
+		if config.UniqueID != "ams_5706567000000000_"+tt.field {
+			t.Errorf("%s: unique ID %q", tt.field, config.UniqueID)
+		}
+		wantDevice := haDevice{[]string{"ams_5706567000000000"}, "house", "Kamstrup", "6841121BN243101040"}
+		if config.Device.Name != wantDevice.Name || config.Device.Identifiers[0] != wantDevice.Identifiers[0] ||
+			config.Device.Manufacturer != wantDevice.Manufacturer || config.Device.Model != wantDevice.Model {
+			t.Errorf("%s: device %+v, want %+v", tt.field, config.Device, wantDevice)
+		}
+
+		// Announced once, not with every reading
+		if _, n := broker.find(topic); n != 1 {
+			t.Errorf("%s published %d times", topic, n)
+		}
+	}
+}
+
+func TestMQTTUnknownRegisters(t *testing.T) {
+	broker := newMQTTBroker(t)
+	p := newTestPublisher(t, broker)
+
+	if err := p.write(testReading(t, "kamstrup_unknown", ""), time.Now()); err != nil {
+		t.Fatalf("write() error = %v", err)
+	}
+
+	var state map[string]interface{}
+	if err := json.Unmarshal([]byte(broker.waitFor(t, "ams/5706567000000000/state").payload), &state); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"1.0.14.7.0.255": 500.0,
+		"1.0.98.1.0.255": -5.0,
+		"1.0.97.1.0.255": "fw 1.2",
+		"1.0.0.2.8.255":  "deadbeef",
+	}
+	for key, value := range want {
+		if state[key] != value {
+			t.Errorf("state[%s] = %v, want %v", key, state[key], value)
+		}
+		if m := broker.waitFor(t, "ams/5706567000000000/"+key); m.payload != fmt.Sprint(value) {
+			t.Errorf("%s = %q, want %v", key, m.payload, value)
+		}
+	}
+
+	// Text sensors have no state class
+	tests := map[string]string{
+		"1_0_14_7_0_255": "measurement",
+		"1_0_97_1_0_255": "",
+		"1_0_0_2_8_255":  "",
+	}
+	for objectID, stateClass := range tests {
+		var config haSensor
+		m := broker.waitFor(t, "homeassistant/sensor/5706567000000000/"+objectID+"/config")
+		if err := json.Unmarshal([]byte(m.payload), &config); err != nil {
+			t.Fatal(err)
+		}
+		if config.StateClass != stateClass {
+			t.Errorf("%s: state class %q, want %q", objectID, config.StateClass, stateClass)
+		}
+	}
+}
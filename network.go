@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+const (
+	dialTimeout = 10 * time.Second
+	keepAlive   = 30 * time.Second
+
+	// idleTimeout is how long a network connection may go without data
+	// before it is considered dead. Meters send at least every 10 seconds.
+	idleTimeout = time.Minute
+)
+
+// errConnectionClosed is returned by network devices when the remote end
+// closes the connection, since io.EOF only means a read timeout on the
+// serial port
+var errConnectionClosed = errors.New("connection closed")
+
+// isNetworkDevice reports whether device is a URL such as tcp://host:port
+// or rfc2217://host:port instead of a serial device name
+func isNetworkDevice(device string) bool {
+	u, err := url.Parse(device)
+	return err == nil && (u.Scheme == "tcp" || u.Scheme == "rfc2217")
+}
+
+// openNetworkDevice connects to a meter behind a TCP bridge such as ser2net.
+// With tcp:// the connection carries the raw byte stream, with rfc2217://
+// the serial port settings are negotiated with RFC 2217 (telnet COM port
+// control) and telnet commands are removed from the stream.
+func openNetworkDevice(device string, config *serial.Config) (io.ReadCloser, error) {
+	u, err := url.Parse(device)
+	if err != nil {
+		return nil, err
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("no port in %s", device)
+	}
+
+	dialer := net.Dialer{Timeout: dialTimeout, KeepAlive: keepAlive}
+	conn, err := dialer.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	stream := &networkStream{conn: conn}
+	if u.Scheme == "tcp" {
+		return stream, nil
+	}
+
+	t := &telnetStream{networkStream: stream}
+	if err := t.negotiate(config); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// networkStream reads from a TCP connection with an idle timeout
+type networkStream struct {
+	conn net.Conn
+}
+
+func (s *networkStream) Read(p []byte) (int, error) {
+	if err := s.conn.SetReadDeadline(time.Now().Add(idleTimeout)); err != nil {
+		return 0, err
+	}
+
+	// A TCP connection does not recover from errors, so every error ends it
+	n, err := s.conn.Read(p)
+	if err == io.EOF {
+		err = errConnectionClosed
+	} else if err != nil {
+		err = fmt.Errorf("%w: %v", errConnectionClosed, err)
+	}
+
+	return n, err
+}
+
+func (s *networkStream) Close() error {
+	return s.conn.Close()
+}
+
+// Telnet and RFC 2217 codes
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetBinary   = 0
+	telnetSGA      = 3
+	telnetComPort  = 44
+	comSetBaud     = 1
+	comSetDataSize = 2
+	comSetParity   = 3
+	comSetStopSize = 4
+)
+
+// telnetStream is a telnet connection with RFC 2217 COM port control
+type telnetStream struct {
+	*networkStream
+
+	state   int // position in a telnet command, see Read
+	command byte
+}
+
+// negotiate enables binary mode and sets the serial port of the bridge
+func (t *telnetStream) negotiate(config *serial.Config) error {
+	msg := []byte{
+		telnetIAC, telnetWILL, telnetBinary,
+		telnetIAC, telnetDO, telnetBinary,
+		telnetIAC, telnetDO, telnetSGA,
+		telnetIAC, telnetWILL, telnetComPort,
+	}
+
+	baud := make([]byte, 4)
+	binary.BigEndian.PutUint32(baud, uint32(config.Baud))
+	msg = append(msg, comPortCommand(comSetBaud, baud...)...)
+	msg = append(msg, comPortCommand(comSetDataSize, config.Size)...)
+
+	// RFC 2217 parity: 1 none, 2 odd, 3 even, 4 mark, 5 space
+	parity := map[serial.Parity]byte{
+		serial.ParityNone: 1, serial.ParityOdd: 2, serial.ParityEven: 3,
+		serial.ParityMark: 4, serial.ParitySpace: 5,
+	}[config.Parity]
+	msg = append(msg, comPortCommand(comSetParity, parity)...)
+
+	// RFC 2217 stop size: 1 one, 2 two, 3 one and a half
+	stop := map[serial.StopBits]byte{
+		serial.Stop1: 1, serial.Stop2: 2, serial.Stop1Half: 3,
+	}[config.StopBits]
+	msg = append(msg, comPortCommand(comSetStopSize, stop)...)
+
+	_, err := t.conn.Write(msg)
+	return err
+}
+
+func comPortCommand(command byte, value ...byte) []byte {
+	msg := []byte{telnetIAC, telnetSB, telnetComPort, command}
+	for _, b := range value {
+		// IAC in the value is doubled
+		msg = append(msg, b)
+		if b == telnetIAC {
+			msg = append(msg, b)
+		}
+	}
+
+	return append(msg, telnetIAC, telnetSE)
+}
+
+// Positions in a telnet command
+const (
+	telnetData = iota
+	telnetCommand
+	telnetOption
+	telnetSubnegotiation
+	telnetSubnegotiationIAC
+)
+
+// Read returns the data bytes, removing telnet commands. Option requests
+// other than those sent by negotiate are refused. Data received together
+// with an error is returned with the error.
+func (t *telnetStream) Read(p []byte) (int, error) {
+	for {
+		n, err := t.networkStream.Read(p)
+
+		out := 0
+		var reply []byte
+
+		for _, b := range p[:n] {
+			switch t.state {
+			case telnetData:
+				if b == telnetIAC {
+					t.state = telnetCommand
+				} else {
+					p[out] = b
+					out++
+				}
+			case telnetCommand:
+				switch b {
+				case telnetIAC: // Escaped 0xff data byte
+					p[out] = b
+					out++
+					t.state = telnetData
+				case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+					t.command = b
+					t.state = telnetOption
+				case telnetSB:
+					t.state = telnetSubnegotiation
+				default:
+					t.state = telnetData
+				}
+			case telnetOption:
+				known := b == telnetBinary || b == telnetSGA || b == telnetComPort
+				if t.command == telnetDO && !known {
+					reply = append(reply, telnetIAC, telnetWONT, b)
+				} else if t.command == telnetWILL && !known {
+					reply = append(reply, telnetIAC, telnetDONT, b)
+				}
+				t.state = telnetData
+			case telnetSubnegotiation:
+				// Replies to the COM port settings are not needed
+				if b == telnetIAC {
+					t.state = telnetSubnegotiationIAC
+				}
+			case telnetSubnegotiationIAC:
+				if b == telnetSE {
+					t.state = telnetData
+				} else {
+					t.state = telnetSubnegotiation
+				}
+			}
+		}
+
+		if len(reply) > 0 && err == nil {
+			_, err = t.conn.Write(reply)
+		}
+		if out > 0 || err != nil {
+			return out, err
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// serveOnce accepts a single connection on a local listener and hands it to
+// serve, returning the address to connect to
+func serveOnce(t *testing.T, serve func(conn net.Conn)) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(conn)
+	}()
+
+	return listener.Addr().String()
+}
+
+// collectFrames reads frames from stream until it ends and returns them with
+// the error that ended it
+func collectFrames(stream io.Reader) ([][]byte, error) {
+	frames := make(chan rawFrame)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- readFrames(stream, frames)
+		close(frames)
+	}()
+
+	var received [][]byte
+	for frame := range frames {
+		received = append(received, frame.data)
+	}
+
+	return received, <-errc
+}
+
+func TestIsNetworkDevice(t *testing.T) {
+	tests := map[string]bool{
+		"tcp://192.168.1.10:2000":     true,
+		"rfc2217://bridge.local:4000": true,
+		"/dev/ttyUSB0":                false,
+		"COM3":                        false,
+		"http://bridge.local:80":      false,
+	}
+
+	for device, want := range tests {
+		if got := isNetworkDevice(device); got != want {
+			t.Errorf("isNetworkDevice(%q) = %v, want %v", device, got, want)
+		}
+	}
+}
+
+func TestTCPDevice(t *testing.T) {
+	list2, list3 := testFrame(t, "kamstrup_list2"), testFrame(t, "kamstrup_list3")
+
+	// Noise before the first frame and frames split over several writes
+	addr := serveOnce(t, func(conn net.Conn) {
+		conn.Write([]byte{0x12, 0x34})
+		conn.Write(list2[:10])
+		time.Sleep(10 * time.Millisecond)
+		conn.Write(list2[10:])
+		conn.Write(list3)
+	})
+
+	stream, err := openDevice("tcp://"+addr, &serial.Config{Baud: 2400})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	frames, err := collectFrames(stream)
+	if !errors.Is(err, errConnectionClosed) {
+		t.Errorf("readFrames() error = %v, want %v", err, errConnectionClosed)
+	}
+	if len(frames) != 2 || !bytes.Equal(frames[0], list2) || !bytes.Equal(frames[1], list3) {
+		t.Errorf("received %x, want %x and %x", frames, list2, list3)
+	}
+}
+
+func TestNetworkDeviceErrors(t *testing.T) {
+	for _, device := range []string{"tcp://127.0.0.1", "rfc2217://%zz"} {
+		if _, err := openDevice(device, &serial.Config{Baud: 2400}); err == nil {
+			t.Errorf("openDevice(%q) succeeded", device)
+		}
+	}
+}
+
+func TestRFC2217Device(t *testing.T) {
+	frame := testFrame(t, "kamstrup_list2")
+	if !bytes.Contains(frame, []byte{telnetIAC}) {
+		t.Fatal("frame has no 0xff byte to escape")
+	}
+
+	config := &serial.Config{Baud: 2400, Size: 8, Parity: serial.ParityEven, StopBits: serial.Stop1}
+	want := []byte{
+		telnetIAC, telnetWILL, telnetBinary,
+		telnetIAC, telnetDO, telnetBinary,
+		telnetIAC, telnetDO, telnetSGA,
+		telnetIAC, telnetWILL, telnetComPort,
+		telnetIAC, telnetSB, telnetComPort, comSetBaud, 0, 0, 0x09, 0x60, telnetIAC, telnetSE,
+		telnetIAC, telnetSB, telnetComPort, comSetDataSize, 8, telnetIAC, telnetSE,
+		telnetIAC, telnetSB, telnetComPort, comSetParity, 3, telnetIAC, telnetSE,
+		telnetIAC, telnetSB, telnetComPort, comSetStopSize, 1, telnetIAC, telnetSE,
+	}
+
+	negotiation := make(chan []byte, 1)
+	addr := serveOnce(t, func(conn net.Conn) {
+		got := make([]byte, len(want))
+		io.ReadFull(conn, got)
+		negotiation <- got
+
+		// Acknowledge the options and settings, then send the frame with
+		// 0xff escaped
+		conn.Write([]byte{
+			telnetIAC, telnetDO, telnetBinary,
+			telnetIAC, telnetWILL, telnetBinary,
+			telnetIAC, telnetDO, telnetComPort,
+			telnetIAC, telnetSB, telnetComPort, 100 + comSetBaud, 0, 0, 0x09, 0x60, telnetIAC, telnetSE,
+		})
+		conn.Write(bytes.ReplaceAll(frame, []byte{telnetIAC}, []byte{telnetIAC, telnetIAC}))
+	})
+
+	stream, err := openDevice("rfc2217://"+addr, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	frames, err := collectFrames(stream)
+	if !errors.Is(err, errConnectionClosed) {
+		t.Errorf("readFrames() error = %v, want %v", err, errConnectionClosed)
+	}
+	if got := <-negotiation; !bytes.Equal(got, want) {
+		t.Errorf("negotiation = % x, want % x", got, want)
+	}
+	if len(frames) != 1 || !bytes.Equal(frames[0], frame) {
+		t.Errorf("received %x, want %x", frames, frame)
+	}
+}
+
+// scriptedConn returns reads one at a time, the last one together with
+// io.EOF, and records what is written to it
+type scriptedConn struct {
+	net.Conn
+	reads   [][]byte
+	written bytes.Buffer
+}
+
+func (c *scriptedConn) Read(p []byte) (int, error) {
+	if len(c.reads) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, c.reads[0])
+	c.reads = c.reads[1:]
+	if len(c.reads) == 0 {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (c *scriptedConn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+func (c *scriptedConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func TestTelnetRead(t *testing.T) {
+	tests := []struct {
+		name  string
+		reads [][]byte
+		data  []byte
+		reply []byte
+	}{
+		{
+			name:  "data",
+			reads: [][]byte{{0x7e, 0xa0}, {0x01, 0x7e}},
+			data:  []byte{0x7e, 0xa0, 0x01, 0x7e},
+		},
+		{
+			name:  "escaped IAC",
+			reads: [][]byte{{0x01, telnetIAC, telnetIAC, 0x02}},
+			data:  []byte{0x01, 0xff, 0x02},
+		},
+		{
+			name:  "escaped IAC split over reads",
+			reads: [][]byte{{0x01, telnetIAC}, {telnetIAC, 0x02}},
+			data:  []byte{0x01, 0xff, 0x02},
+		},
+		{
+			name: "commands removed",
+			reads: [][]byte{
+				{0x01, telnetIAC, telnetWILL, telnetBinary, telnetIAC, telnetDO, telnetSGA},
+				{telnetIAC, 241, 0x02}, // NOP
+			},
+			data: []byte{0x01, 0x02},
+		},
+		{
+			name: "subnegotiation skipped",
+			reads: [][]byte{
+				{telnetIAC, telnetSB, telnetComPort, 101, 0, 0, telnetIAC, telnetIAC},
+				{0x60, telnetIAC, telnetSE, 0x01},
+			},
+			data: []byte{0x01},
+		},
+		{
+			name: "unknown options refused",
+			reads: [][]byte{
+				{telnetIAC, telnetDO, 24, 0x01, telnetIAC, telnetWILL, 1},
+				{telnetIAC, telnetDO, telnetComPort, telnetIAC, telnetWONT, 5, telnetIAC, telnetDONT, 6},
+				{0x02},
+			},
+			data:  []byte{0x01, 0x02},
+			reply: []byte{telnetIAC, telnetWONT, 24, telnetIAC, telnetDONT, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &scriptedConn{reads: tt.reads}
+			stream := &telnetStream{networkStream: &networkStream{conn: conn}}
+
+			var data []byte
+			buffer := make([]byte, 64)
+			for {
+				n, err := stream.Read(buffer)
+				data = append(data, buffer[:n]...)
+				if err != nil {
+					if !errors.Is(err, errConnectionClosed) {
+						t.Errorf("Read() error = %v, want %v", err, errConnectionClosed)
+					}
+					break
+				}
+			}
+
+			if !bytes.Equal(data, tt.data) {
+				t.Errorf("data = % x, want % x", data, tt.data)
+			}
+			if !bytes.Equal(conn.written.Bytes(), tt.reply) {
+				t.Errorf("reply = % x, want % x", conn.written.Bytes(), tt.reply)
+			}
+		})
+	}
+}
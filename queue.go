@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSegmentSize is the size at which a new queue segment is started. A
+// segment is sent to InfluxDB in a single request.
+const maxSegmentSize = 256 * 1024
+
+const segmentSuffix = ".lp"
+
+// badSuffix is added to segments that cannot be read, so they are kept for
+// inspection but not loaded again
+const badSuffix = ".bad"
+
+// diskQueue is a persistent FIFO of points in line protocol with nanosecond
+// timestamps. Points are appended to the newest segment file in dir and
+// sent from the oldest one. When the queue grows beyond maxSize the oldest
+// segments are dropped.
+type diskQueue struct {
+	dir     string
+	maxSize int64
+
+	mu       sync.Mutex
+	segments []*segment // oldest first, the last one is open for writing
+	size     int64
+	points   int
+	current  *os.File
+	nextID   int64
+}
+
+// segment is a queue file with the size and number of points written to it
+type segment struct {
+	name   string
+	size   int64
+	points int
+}
+
+func openDiskQueue(dir string, maxSize int64) (*diskQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	q := &diskQueue{dir: dir, maxSize: maxSize, nextID: time.Now().UnixNano()}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		seg := &segment{name: name, size: int64(len(data)), points: bytes.Count(data, []byte("\n"))}
+		q.segments = append(q.segments, seg)
+		q.size += seg.size
+		q.points += seg.points
+	}
+
+	return q, nil
+}
+
+// depth returns the number of queued points and their size in bytes
+func (q *diskQueue) depth() (int, int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.points, q.size
+}
+
+func (q *diskQueue) empty() bool {
+	points, _ := q.depth()
+	return points == 0
+}
+
+// push appends a point to the queue
+func (q *diskQueue) push(line string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.current == nil {
+		// Segment names sort in creation order
+		name := filepath.Join(q.dir, fmt.Sprintf("%020d%s", q.nextID, segmentSuffix))
+		q.nextID++
+
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		q.current = f
+		q.segments = append(q.segments, &segment{name: name})
+	}
+
+	if _, err := q.current.WriteString(line); err != nil {
+		return err
+	}
+	if err := q.current.Sync(); err != nil {
+		return err
+	}
+	seg := q.segments[len(q.segments)-1]
+	seg.size += int64(len(line))
+	seg.points++
+	q.size += int64(len(line))
+	q.points++
+
+	if info, err := q.current.Stat(); err == nil && info.Size() >= maxSegmentSize {
+		q.closeCurrent()
+	}
+
+	for q.size > q.maxSize && len(q.segments) > 1 {
+		slog.Warn("Queue is full, dropping oldest segment", "max_size", q.maxSize)
+		q.removeLocked(q.segments[0].name)
+	}
+
+	return nil
+}
+
+// oldest returns the name and content of the oldest segment. The segment
+// being written to is closed first, so no more points are added to it.
+func (q *diskQueue) oldest() (string, []byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.segments) == 0 {
+		return "", nil, nil
+	}
+	if len(q.segments) == 1 && q.current != nil {
+		q.closeCurrent()
+	}
+
+	name := q.segments[0].name
+	data, err := os.ReadFile(name)
+	return name, data, err
+}
+
+// remove deletes a segment returned by oldest once its points are sent
+func (q *diskQueue) remove(name string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.removeLocked(name)
+}
+
+// quarantine takes a segment returned by oldest that cannot be read out of
+// the queue, renaming it if it still exists
+func (q *diskQueue) quarantine(name string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.dropLocked(name) {
+		return
+	}
+	err := os.Rename(name, name+badSuffix)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("Error renaming queue segment", "segment", filepath.Base(name), "error", err)
+	}
+}
+
+func (q *diskQueue) removeLocked(name string) {
+	if !q.dropLocked(name) {
+		return
+	}
+	if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("Error removing queue segment", "segment", filepath.Base(name), "error", err)
+	}
+}
+
+// dropLocked takes a segment out of the queue, closing it if it is being
+// written to. It returns false if the segment is not queued.
+func (q *diskQueue) dropLocked(name string) bool {
+	for i, seg := range q.segments {
+		if seg.name != name {
+			continue
+		}
+
+		if i == len(q.segments)-1 && q.current != nil {
+			q.closeCurrent()
+		}
+		q.size -= seg.size
+		q.points -= seg.points
+		q.segments = append(q.segments[:i], q.segments[i+1:]...)
+		return true
+	}
+
+	return false
+}
+
+func (q *diskQueue) closeCurrent() {
+	if err := q.current.Close(); err != nil {
+		slog.Error("Error closing queue segment", "error", err)
+	}
+	q.current = nil
+}
+
+// bufferedWriter writes to InfluxDB and queues the points on disk while
+// InfluxDB is unreachable. Queued points are replayed in order, new points
+// are queued behind them until the queue is empty.
+type bufferedWriter struct {
+	influx *influxWriter
+	queue  *diskQueue
+	wake   chan struct{}
+}
+
+// Replay backoff limits
+const (
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+)
+
+func newBufferedWriter(influx *influxWriter, queue *diskQueue) *bufferedWriter {
+	w := &bufferedWriter{influx: influx, queue: queue, wake: make(chan struct{}, 1)}
+
+	if points, size := queue.depth(); points > 0 {
+		slog.Info("Queue holds points from a previous run", "points", points, "bytes", size)
+	}
+	go w.replay()
+
+	return w
+}
+
+func (w *bufferedWriter) name() string {
+	return w.influx.name()
+}
+
+func (w *bufferedWriter) write(reading *meterReading, timestamp time.Time) error {
+	if w.queue.empty() {
+		err := w.influx.write(reading, timestamp)
+		if err == nil || errors.Is(err, errRejected) {
+			return err
+		}
+		slog.Warn("Error writing to database, queueing", "error", err)
+	}
+
+	// Truncate to the configured precision, the queue always uses nanoseconds
+	precision := precisions[w.influx.precision]
+	line := lineProtocol(reading, timestamp.Truncate(precision), time.Nanosecond)
+	if line == "" {
+		return nil
+	}
+	if err := w.queue.push(line); err != nil {
+		return fmt.Errorf("error queueing point: %w", err)
+	}
+
+	points, size := w.queue.depth()
+	slog.Info("Points queued", "points", points, "bytes", size)
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// replay sends the queued segments, oldest first, with exponential backoff
+// while InfluxDB fails
+func (w *bufferedWriter) replay() {
+	backoff := minBackoff
+
+	for {
+		name, data, err := w.queue.oldest()
+		if err != nil {
+			// Retrying would not read it either, so skip to the next one
+			slog.Error("Error reading queue segment, skipping it", "segment", filepath.Base(name), "error", err)
+			w.queue.quarantine(name)
+			continue
+		}
+		if name == "" {
+			<-w.wake
+			continue
+		}
+
+		err = w.influx.writeLines(string(data), "ns")
+		if errors.Is(err, errRejected) {
+			slog.Error("Dropping queue segment", "segment", filepath.Base(name), "error", err)
+		} else if err != nil {
+			slog.Warn("Error replaying queue, retrying", "delay", backoff, "error", err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+
+		w.queue.remove(name)
+		backoff = minBackoff
+
+		points, size := w.queue.depth()
+		slog.Info("Replayed queued points", "replayed", strings.Count(string(data), "\n"), "points", points, "bytes", size)
+	}
+}
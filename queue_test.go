@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestQueue(t *testing.T, dir string, maxSize int64) *diskQueue {
+	t.Helper()
+
+	q, err := openDiskQueue(dir, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if q.current != nil {
+			q.closeCurrent()
+		}
+	})
+
+	return q
+}
+
+// pushSegment pushes line into a segment of its own
+func pushSegment(t *testing.T, q *diskQueue, line string) {
+	t.Helper()
+
+	if err := q.push(line); err != nil {
+		t.Fatalf("push() error = %v", err)
+	}
+	q.mu.Lock()
+	q.closeCurrent()
+	q.mu.Unlock()
+}
+
+func checkDepth(t *testing.T, q *diskQueue, points int, size int64) {
+	t.Helper()
+
+	if p, s := q.depth(); p != points || s != size {
+		t.Errorf("depth() = %d, %d, want %d, %d", p, s, points, size)
+	}
+}
+
+func TestDiskQueue(t *testing.T) {
+	dir := t.TempDir()
+	q := openTestQueue(t, dir, 1024*1024)
+
+	if name, _, err := q.oldest(); name != "" || err != nil {
+		t.Fatalf("oldest() of empty queue = %q, %v", name, err)
+	}
+
+	lines := []string{"data,meter=1 active_power_plus=1 1\n", "data,meter=1 active_power_plus=2 2\n"}
+	for _, line := range lines {
+		if err := q.push(line); err != nil {
+			t.Fatalf("push() error = %v", err)
+		}
+	}
+	size := int64(len(lines[0]) + len(lines[1]))
+	checkDepth(t, q, 2, size)
+
+	// Points pushed after oldest go to a new segment
+	name, data, err := q.oldest()
+	if err != nil || string(data) != lines[0]+lines[1] {
+		t.Fatalf("oldest() = %q, %v", data, err)
+	}
+	if err := q.push(lines[0]); err != nil {
+		t.Fatalf("push() error = %v", err)
+	}
+
+	// The queue is read again after a restart
+	reopened := openTestQueue(t, dir, 1024*1024)
+	checkDepth(t, reopened, 3, size+int64(len(lines[0])))
+
+	q.remove(name)
+	checkDepth(t, q, 1, int64(len(lines[0])))
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("sent segment not removed: %v", err)
+	}
+
+	next, data, err := q.oldest()
+	if err != nil || next == name || string(data) != lines[0] {
+		t.Fatalf("oldest() = %s %q, %v", next, data, err)
+	}
+	q.remove(next)
+	if !q.empty() {
+		t.Error("queue not empty after removing every segment")
+	}
+}
+
+func TestDiskQueueFull(t *testing.T) {
+	line := "data,meter=1 active_power_plus=1 1\n"
+	q := openTestQueue(t, t.TempDir(), int64(3*len(line)))
+
+	// One point per segment, so the oldest are dropped one at a time
+	for i := 0; i < 5; i++ {
+		pushSegment(t, q, line)
+	}
+
+	checkDepth(t, q, 3, int64(3*len(line)))
+	if len(q.segments) != 3 {
+		t.Errorf("queue has %d segments, want 3", len(q.segments))
+	}
+}
+
+func TestDiskQueueQuarantine(t *testing.T) {
+	line := "data,meter=1 active_power_plus=1 1\n"
+	q := openTestQueue(t, t.TempDir(), 1024*1024)
+
+	for i := 0; i < 2; i++ {
+		pushSegment(t, q, line)
+	}
+
+	// An unreadable segment is renamed, a missing one only dropped
+	name := q.segments[0].name
+	os.Remove(name)
+	os.Mkdir(name, 0755)
+	if _, _, err := q.oldest(); err == nil {
+		t.Fatal("oldest() of a directory succeeded")
+	}
+	q.quarantine(name)
+	if _, err := os.Stat(name + badSuffix); err != nil {
+		t.Errorf("segment not renamed: %v", err)
+	}
+
+	name = q.segments[0].name
+	os.Remove(name)
+	q.quarantine(name)
+	if !q.empty() || len(q.segments) != 0 {
+		t.Errorf("queue has %d segments after quarantining both", len(q.segments))
+	}
+}
+
+func TestBufferedWriterReplay(t *testing.T) {
+	dir := t.TempDir()
+	q := openTestQueue(t, dir, 1024*1024)
+
+	// Three segments, of which the first is deleted behind the queue's back
+	lines := []string{
+		"data,meter=1 active_power_plus=1 1\n",
+		"data,meter=1 active_power_plus=2 2\n",
+		"data,meter=1 active_power_plus=3 3\n",
+	}
+	for _, line := range lines {
+		pushSegment(t, q, line)
+	}
+	os.Remove(q.segments[0].name)
+
+	server, requests := newInfluxServer(t, http.StatusNoContent, "")
+	influx := newInfluxWriter(server.URL, 1, "s")
+	influx.database = "meter"
+	newBufferedWriter(influx, q)
+
+	for _, want := range lines[1:] {
+		select {
+		case r := <-requests:
+			if r.body != want || r.query.Get("precision") != "ns" {
+				t.Errorf("replayed %q with precision %s, want %q", r.body, r.query.Get("precision"), want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("queue not replayed")
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !q.empty() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkDepth(t, q, 0, 0)
+	if names, _ := filepath.Glob(filepath.Join(dir, "*")); len(names) != 0 {
+		t.Errorf("files left in queue: %s", strings.Join(names, " "))
+	}
+}
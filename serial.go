@@ -1,27 +1,252 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
 
 	"github.com/tarm/serial"
+
+	"kamstrup_ams_logger/ams"
 )
 
-func openSerialDevice(device string) (*serial.Port, error) {
-	log.Printf("Trying to open serial port on device %s", device)
+// parities maps the -parity option to the serial port parity
+var parities = map[string]serial.Parity{
+	"none":  serial.ParityNone,
+	"odd":   serial.ParityOdd,
+	"even":  serial.ParityEven,
+	"mark":  serial.ParityMark,
+	"space": serial.ParitySpace,
+}
+
+// stopBits maps the -stop-bits option to the serial port stop bits
+var stopBits = map[string]serial.StopBits{
+	"1":   serial.Stop1,
+	"1.5": serial.Stop1Half,
+	"2":   serial.Stop2,
+}
 
+// maxReadTimeout is the longest read timeout the serial port supports, the
+// timeout is set in tenths of a second in a single byte
+const maxReadTimeout = 25500 * time.Millisecond
+
+// newSerialConfig returns the serial port settings given on the command
+// line. A baud rate of 0 selects automatic detection.
+func newSerialConfig(baud int, dataBits int, parity string, stop string, readTimeout time.Duration) (*serial.Config, error) {
 	config := &serial.Config{
-		Name:        device,
-		Baud:        2400,
-		Size:        8,
-		Parity:      serial.ParityNone,
-		StopBits:    serial.Stop1,
-		ReadTimeout: 4,
+		Baud:        baud,
+		Size:        byte(dataBits),
+		ReadTimeout: readTimeout,
+	}
+
+	var ok bool
+	if config.Parity, ok = parities[parity]; !ok {
+		return nil, fmt.Errorf("invalid parity %q, must be none, odd, even, mark or space", parity)
+	}
+	if config.StopBits, ok = stopBits[stop]; !ok {
+		return nil, fmt.Errorf("invalid stop bits %q, must be 1, 1.5 or 2", stop)
+	}
+	if baud < 0 {
+		return nil, fmt.Errorf("invalid baud rate %d", baud)
+	}
+	if dataBits < 5 || dataBits > 8 {
+		return nil, fmt.Errorf("invalid data bits %d, must be 5 to 8", dataBits)
+	}
+	if readTimeout <= 0 || readTimeout > maxReadTimeout {
+		return nil, fmt.Errorf("invalid read timeout %v, must be positive and at most %v", readTimeout, maxReadTimeout)
 	}
 
-	stream, err := serial.OpenPort(config)
+	return config, nil
+}
+
+// describeSerial formats serial port settings in the usual short form, e.g.
+// 2400 8N1
+func describeSerial(config *serial.Config) string {
+	var parity string
+	for name, p := range parities {
+		if p == config.Parity {
+			parity = strings.ToUpper(name[:1])
+		}
+	}
+	var stop string
+	for name, s := range stopBits {
+		if s == config.StopBits {
+			stop = name
+		}
+	}
+
+	return fmt.Sprintf("%d %d%s%s", config.Baud, config.Size, parity, stop)
+}
+
+// openSerialDevice opens device with the settings of config. If config has no
+// baud rate the settings are detected and stored in config, so they are
+// reused when the device is opened again.
+func openSerialDevice(device string, config *serial.Config) (io.ReadCloser, error) {
+	if config.Baud == 0 {
+		return detectSerialSettings(device, config)
+	}
+
+	c := *config
+	c.Name = device
+	port, err := serial.OpenPort(&c)
 	if err != nil {
 		return nil, err
 	}
 
-	return stream, nil
+	return &serialStream{Port: port, timeout: config.ReadTimeout}, nil
+}
+
+// errDeviceGone is returned when the serial device has been removed
+var errDeviceGone = errors.New("device removed")
+
+// maxReadErrors is the number of failed reads in a row after which the
+// device is considered disconnected
+const maxReadErrors = 5
+
+// serialStream is a serial port that detects the removal of its device. The
+// port returns io.EOF both on read timeout and when the device is gone, but
+// in the latter case without waiting for the timeout.
+type serialStream struct {
+	*serial.Port
+	timeout time.Duration
+	early   int // io.EOF returned before the timeout in a row
+}
+
+func (s *serialStream) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := s.Port.Read(p)
+
+	if n == 0 && err == io.EOF && time.Since(start) < s.timeout/2 {
+		if s.early++; s.early >= maxReadErrors {
+			return 0, errDeviceGone
+		}
+	} else {
+		s.early = 0
+	}
+
+	return n, err
+}
+
+// serialCandidates are the settings tried by detectSerialSettings, most
+// common first. M-Bus adapters on the HAN port use 2400 baud, other
+// interfaces and meters use higher rates.
+var serialCandidates = []serial.Config{
+	{Baud: 2400, Size: 8, Parity: serial.ParityNone, StopBits: serial.Stop1},
+	{Baud: 2400, Size: 8, Parity: serial.ParityEven, StopBits: serial.Stop1},
+	{Baud: 9600, Size: 8, Parity: serial.ParityNone, StopBits: serial.Stop1},
+	{Baud: 9600, Size: 8, Parity: serial.ParityEven, StopBits: serial.Stop1},
+	{Baud: 19200, Size: 8, Parity: serial.ParityNone, StopBits: serial.Stop1},
+	{Baud: 38400, Size: 8, Parity: serial.ParityNone, StopBits: serial.Stop1},
+	{Baud: 115200, Size: 8, Parity: serial.ParityNone, StopBits: serial.Stop1},
+	{Baud: 115200, Size: 8, Parity: serial.ParityEven, StopBits: serial.Stop1},
+}
+
+// detectTimeout is how long every candidate is listened to. Most meters send
+// a list every 10 seconds or more often.
+const detectTimeout = 12 * time.Second
+
+// detectSerialSettings tries the candidate settings in turn until a frame
+// with valid framing and checksums is received, stores those settings in
+// config and returns the port opened with them. It keeps cycling through the
+// candidates until one works or the device fails.
+func detectSerialSettings(device string, config *serial.Config) (io.ReadCloser, error) {
+	slog.Info("Detecting serial port settings", "device", device)
+
+	for {
+		for _, candidate := range serialCandidates {
+			c := candidate
+			c.Name = device
+			c.ReadTimeout = config.ReadTimeout
+
+			port, err := serial.OpenPort(&c)
+			if err != nil {
+				return nil, err
+			}
+			stream := &serialStream{Port: port, timeout: c.ReadTimeout}
+
+			ok, err := receivesFrames(stream)
+			if ok {
+				slog.Info("Detected serial port settings", "device", device, "settings", describeSerial(&c))
+				c.Name = ""
+				*config = c
+				return stream, nil
+			}
+
+			stream.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// receivesFrames reports whether a valid frame is read from stream within
+// detectTimeout
+func receivesFrames(stream io.Reader) (bool, error) {
+	var deframer ams.Deframer
+	buffer := make([]byte, 1024)
+	deadline := time.Now().Add(detectTimeout)
+
+	for time.Now().Before(deadline) {
+		numBytes, err := stream.Read(buffer)
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+		deframer.Write(buffer[:numBytes])
+
+		for frame := deframer.Next(); frame != nil; frame = deframer.Next() {
+			// Only the framing is checked, the content may be unsupported
+			_, err := ams.Decode(frame)
+			if !errors.Is(err, ams.ErrInvalidFrame) && !errors.Is(err, ams.ErrChecksum) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// rawFrame is a complete HDLC frame as received from the meter
+type rawFrame struct {
+	data     []byte
+	received time.Time
+}
+
+// readFrames reads the HDLC byte stream from stream and sends every complete
+// frame on the frames channel until reading fails maxReadErrors times in a
+// row. io.EOF is returned by the serial port on read timeout and is not
+// treated as the end of the stream.
+func readFrames(stream io.Reader, frames chan<- rawFrame) error {
+	var deframer ams.Deframer
+	buffer := make([]byte, 1024)
+	failures := 0
+
+	for {
+		// Data read together with an error is still used
+		numBytes, err := stream.Read(buffer)
+		if numBytes > 0 {
+			deframer.Write(buffer[:numBytes])
+
+			for frame := deframer.Next(); frame != nil; frame = deframer.Next() {
+				frames <- rawFrame{frame, time.Now()}
+			}
+			if n := deframer.Discarded(); n > 0 {
+				slog.Debug("Skipped bytes outside of frame", "bytes", n)
+			}
+		}
+
+		if errors.Is(err, errDeviceGone) || errors.Is(err, errConnectionClosed) {
+			return err
+		} else if err != nil && err != io.EOF {
+			if failures++; failures >= maxReadErrors {
+				return err
+			}
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		failures = 0
+	}
 }
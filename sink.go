@@ -0,0 +1,124 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kamstrup_ams_logger/ams"
+)
+
+// meterReading is a decoded reading with the label the user gave its meter,
+// which may be empty
+type meterReading struct {
+	*ams.Reading
+	label string
+}
+
+// Sink is an output the decoded readings are written to. Every sink is
+// written from its own goroutine and gets the same reading, which it must
+// not modify.
+type Sink interface {
+	name() string
+	write(reading *meterReading, timestamp time.Time) error
+}
+
+// sinkCloser is implemented by sinks that hold files, which are closed when
+// the logger stops
+type sinkCloser interface {
+	close() error
+}
+
+// sinkBufferSize is the number of readings buffered per sink. Readings for a
+// sink whose buffer is full are dropped, so a slow sink cannot stall the
+// serial read loop or the other sinks. Replay waits for room instead.
+const sinkBufferSize = 64
+
+type sinkItem struct {
+	reading   *meterReading
+	timestamp time.Time
+}
+
+// sinkWorker writes to one sink from its own goroutine
+type sinkWorker struct {
+	sink  Sink
+	items chan sinkItem
+
+	failures atomic.Int64
+	dropped  atomic.Int64
+}
+
+// fanOut passes every reading to all sinks. A blocking fanOut waits for
+// room in the buffer of every sink instead of dropping readings, which is
+// used for replay where no reading should be lost.
+type fanOut struct {
+	workers  []*sinkWorker
+	wg       sync.WaitGroup
+	blocking bool
+}
+
+func newFanOut(sinks []Sink) *fanOut {
+	f := &fanOut{}
+
+	for _, sink := range sinks {
+		w := &sinkWorker{sink: sink, items: make(chan sinkItem, sinkBufferSize)}
+		f.workers = append(f.workers, w)
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			w.run()
+		}()
+	}
+
+	return f
+}
+
+// write hands the reading to every sink without waiting for them to write
+// it
+func (f *fanOut) write(reading *meterReading, timestamp time.Time) {
+	for _, w := range f.workers {
+		if f.blocking {
+			w.items <- sinkItem{reading, timestamp}
+			continue
+		}
+
+		select {
+		case w.items <- sinkItem{reading, timestamp}:
+		default:
+			dropped := w.dropped.Add(1)
+			slog.Warn("Sink is not keeping up, reading dropped", "sink", w.sink.name(), "dropped", dropped)
+		}
+	}
+}
+
+// close waits until every sink has written the readings buffered for it,
+// then closes the sinks
+func (f *fanOut) close() {
+	for _, w := range f.workers {
+		close(w.items)
+	}
+	f.wg.Wait()
+	f.closeSinks()
+}
+
+// closeSinks closes the sinks that hold files. It is also used on shutdown
+// while readings are still written, sinks reject them once closed.
+func (f *fanOut) closeSinks() {
+	for _, w := range f.workers {
+		if c, ok := w.sink.(sinkCloser); ok {
+			if err := c.close(); err != nil {
+				slog.Error("Error closing sink", "sink", w.sink.name(), "error", err)
+			}
+		}
+	}
+}
+
+func (w *sinkWorker) run() {
+	for item := range w.items {
+		if err := w.sink.write(item.reading, item.timestamp); err != nil {
+			failures := w.failures.Add(1)
+			slog.Error("Error writing reading", "sink", w.sink.name(), "error", err, "failures", failures)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowSink counts the readings written to it, taking delay for each
+type slowSink struct {
+	delay   time.Duration
+	written atomic.Int64
+}
+
+func (s *slowSink) name() string {
+	return "slow"
+}
+
+func (s *slowSink) write(reading *meterReading, timestamp time.Time) error {
+	time.Sleep(s.delay)
+	s.written.Add(1)
+	return nil
+}
+
+func TestFanOutDropsForSlowSink(t *testing.T) {
+	reading := testReading(t, "kamstrup_list2", "")
+	slow := &slowSink{delay: 10 * time.Millisecond}
+	output := newFanOut([]Sink{slow})
+
+	for i := 0; i < 2*sinkBufferSize; i++ {
+		output.write(reading, time.Now())
+	}
+	output.close()
+
+	if n := slow.written.Load() + output.workers[0].dropped.Load(); n != 2*sinkBufferSize {
+		t.Errorf("written and dropped %d readings, want %d", n, 2*sinkBufferSize)
+	}
+	if output.workers[0].dropped.Load() == 0 {
+		t.Error("no reading dropped")
+	}
+}